@@ -0,0 +1,254 @@
+package otz
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/ShadowsGtt/otz/errs"
+	"github.com/ShadowsGtt/otz/log"
+	"github.com/gin-gonic/gin"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+const (
+	// adminServiceName 管理端口的服务名称, 热重启时按该名称传递listener
+	adminServiceName = "otz_admin"
+
+	codeUnauthorized = 401
+	codeForbidden    = 403
+)
+
+var processStartTime = time.Now()
+
+// AdminConfig 管理端口配置, address为空时不开启
+// 提供 /metrics, /debug/pprof/, /debug/info, /debug/config, /debug/routes, /debug/log 接口
+type AdminConfig struct {
+	// Address 监听地址 ip:port, 建议只监听内网地址
+	Address string `yaml:"address"`
+	// Token 请求需要携带请求头 Authorization: Bearer <token>, 为空不校验
+	Token Secret `yaml:"token"`
+	// AllowIPs 允许访问的客户端IP或CIDR, 为空不限制, 使用连接的对端地址, 不信任X-Forwarded-For
+	AllowIPs []string `yaml:"allow_ips"`
+}
+
+// Enabled 是否开启管理端口
+func (c *AdminConfig) Enabled() bool {
+	return c.Address != ""
+}
+
+// parseAllowIPs 解析IP及CIDR
+func parseAllowIPs(items []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(items))
+	for _, item := range items {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %q", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q", item)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// Admin 管理端口服务, 可以注册自定义的内部接口, 未开启时Start返回错误
+func (s *Server) Admin() *Service {
+	for _, svc := range s.services {
+		if svc.cfg.Name == adminServiceName {
+			return svc
+		}
+	}
+	svc := s.Service(adminServiceName)
+	svc.mutex.Lock()
+	svc.err = errors.New("admin server not enabled, set server.admin.address")
+	svc.mutex.Unlock()
+	return svc
+}
+
+// newAdminService 创建管理端口服务并注册内置接口
+func (s *Server) newAdminService(c AdminConfig) (*Service, error) {
+	allowIPs, err := parseAllowIPs(c.AllowIPs)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token == "" && len(allowIPs) == 0 {
+		s.warnf("admin server %s is not protected, set server.admin.token or server.admin.allow_ips", c.Address)
+	}
+	svc := newService(s, ServiceConfig{Name: adminServiceName, Network: NetworkTCP, Address: c.Address})
+	svc.engine.Use(s.adminAuth(c.Token.Value(), allowIPs))
+
+	svc.engine.Any("/debug/pprof/*name", func(ginCtx *gin.Context) {
+		switch ginCtx.Param("name") {
+		case "/cmdline":
+			pprof.Cmdline(ginCtx.Writer, ginCtx.Request)
+		case "/profile":
+			pprof.Profile(ginCtx.Writer, ginCtx.Request)
+		case "/symbol":
+			pprof.Symbol(ginCtx.Writer, ginCtx.Request)
+		case "/trace":
+			pprof.Trace(ginCtx.Writer, ginCtx.Request)
+		default:
+			pprof.Index(ginCtx.Writer, ginCtx.Request)
+		}
+	})
+	svc.engine.GET(metricsPath, gin.WrapH(MetricsHandler()))
+	svc.engine.GET("/debug/info", func(ginCtx *gin.Context) {
+		writeAdminRsp(ginCtx, runtimeInfo(), nil)
+	})
+	svc.engine.GET("/debug/config", func(ginCtx *gin.Context) {
+		// 密钥及敏感key已脱敏
+		ginCtx.Data(http.StatusOK, "text/yaml; charset=utf-8", []byte(s.currentConfig().Dump()))
+	})
+	svc.engine.GET("/debug/routes", func(ginCtx *gin.Context) {
+		writeAdminRsp(ginCtx, s.routes(), nil)
+	})
+	svc.engine.GET("/debug/log", func(ginCtx *gin.Context) {
+		data, err := s.logLevels()
+		writeAdminRsp(ginCtx, data, err)
+	})
+	return svc, nil
+}
+
+// adminAuth 校验客户端IP及token
+func (s *Server) adminAuth(token string, allowIPs []*net.IPNet) gin.HandlerFunc {
+	return func(ginCtx *gin.Context) {
+		if len(allowIPs) > 0 {
+			ip := net.ParseIP(ginCtx.RemoteIP())
+			allowed := false
+			for _, ipNet := range allowIPs {
+				if ip != nil && ipNet.Contains(ip) {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				s.warnf("admin request from %s denied, path: %s", ginCtx.RemoteIP(), ginCtx.Request.URL.Path)
+				ginCtx.Abort()
+				ginCtx.JSON(http.StatusForbidden, gin.H{"code": codeForbidden, "msg": "ip not allowed"})
+				return
+			}
+		}
+		if token != "" {
+			// 只接受请求头, url中的token会出现在访问日志及代理日志中
+			got := ""
+			if auth := ginCtx.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+				got = strings.TrimPrefix(auth, "Bearer ")
+			}
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				ginCtx.Abort()
+				ginCtx.JSON(http.StatusUnauthorized, gin.H{"code": codeUnauthorized, "msg": "invalid token"})
+				return
+			}
+		}
+		ginCtx.Next()
+	}
+}
+
+// runtimeInfo 构建信息及运行时状态
+func runtimeInfo() gin.H {
+	info := gin.H{
+		"go_version": runtime.Version(),
+		"pid":        os.Getpid(),
+		"goroutines": runtime.NumGoroutine(),
+		"num_cpu":    runtime.NumCPU(),
+		"gomaxprocs": runtime.GOMAXPROCS(0),
+		"start_time": processStartTime.Format(time.RFC3339),
+		"uptime":     time.Since(processStartTime).Round(time.Second).String(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		info["path"] = bi.Main.Path
+		info["version"] = bi.Main.Version
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info["commit"] = setting.Value
+			case "vcs.time":
+				info["commit_time"] = setting.Value
+			case "vcs.modified":
+				info["dirty"] = setting.Value == "true"
+			}
+		}
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	info["memory"] = gin.H{
+		"heap_alloc":  mem.HeapAlloc,
+		"heap_inuse":  mem.HeapInuse,
+		"sys":         mem.Sys,
+		"num_gc":      mem.NumGC,
+		"pause_total": time.Duration(mem.PauseTotalNs).String(),
+	}
+	return info
+}
+
+// routeInfo 注册的接口
+type routeInfo struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+}
+
+// routes 各服务注册的http接口及grpc方法
+func (s *Server) routes() map[string][]routeInfo {
+	routes := map[string][]routeInfo{}
+	for _, svc := range s.services {
+		list := make([]routeInfo, 0)
+		for _, r := range svc.engine.Routes() {
+			list = append(list, routeInfo{Method: r.Method, Path: r.Path})
+		}
+		svc.mutex.Lock()
+		for _, g := range svc.grpcServices {
+			for _, m := range g.desc.Methods {
+				list = append(list, routeInfo{Method: "GRPC", Path: "/" + g.desc.ServiceName + "/" + m.MethodName})
+			}
+			for _, st := range g.desc.Streams {
+				list = append(list, routeInfo{Method: "GRPC_STREAM", Path: "/" + g.desc.ServiceName + "/" + st.StreamName})
+			}
+		}
+		svc.mutex.Unlock()
+		routes[svc.cfg.Name] = list
+	}
+	return routes
+}
+
+// logLevels 当前日志输出等级及等级提升规则
+func (s *Server) logLevels() (gin.H, error) {
+	data := gin.H{"level_rules": log.LevelRules()}
+	if s.opts.logger != nil {
+		// 使用WithLogger指定的日志不读取log配置
+		data["custom_logger"] = true
+		return data, nil
+	}
+	outputs := []log.Config{{OutputType: log.OutputTypeConsole}}
+	if node := s.currentConfig().Log; node.Kind != 0 {
+		if err := node.Decode(&outputs); err != nil {
+			return nil, errs.New(http.StatusInternalServerError, err.Error())
+		}
+	}
+	list := make([]gin.H, 0, len(outputs))
+	for _, c := range outputs {
+		level := c.Level
+		if level == "" {
+			level = "debug"
+		}
+		list = append(list, gin.H{"output_type": c.OutputType, "file_name": c.FileName, "level": level})
+	}
+	data["outputs"] = list
+	return data, nil
+}
@@ -0,0 +1,137 @@
+package otz
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ShadowsGtt/otz/log/logtest"
+	"github.com/ShadowsGtt/otz/otzctx"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdmin(t *testing.T) {
+	cfg, err := ParseConfig("otz_go.yaml", []byte(`server:
+  ip: 127.0.0.1
+  port: 8080
+  admin:
+    address: 127.0.0.1:0
+    token: s3cret
+    allow_ips: [127.0.0.1, 10.0.0.0/8]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(WithConfig(cfg), WithLogger(logtest.New()), WithListener(ln))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Register("/hello", func(ctx context.Context) {
+		otzctx.OTZContext(ctx).GetGinCtx().String(http.StatusOK, "hello")
+	})
+	admin := s.Admin()
+	if admin.Name() != adminServiceName {
+		t.Fatalf("unexpected admin service %s", admin.Name())
+	}
+
+	get := func(remoteAddr, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = remoteAddr
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		admin.engine.ServeHTTP(w, req)
+		return w
+	}
+	if w := get("192.168.1.1:1234", "/debug/info", "s3cret"); w.Code != http.StatusForbidden {
+		t.Fatalf("ip not in allow_ips should be denied, got %d", w.Code)
+	}
+	if w := get("10.1.2.3:1234", "/debug/info", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("invalid token should be denied, got %d", w.Code)
+	}
+	if w := get("127.0.0.1:1234", "/debug/info?token=s3cret", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("token in url should be denied, got %d", w.Code)
+	}
+	if w := get("127.0.0.1:1234", "/debug/pprof/goroutine?debug=1", "s3cret"); w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), "goroutine profile") {
+		t.Fatalf("unexpected pprof response %d %s", w.Code, w.Body.String())
+	}
+
+	rsp := struct {
+		Code int                    `json:"code"`
+		Data map[string]interface{} `json:"data"`
+	}{}
+	w := get("127.0.0.1:1234", "/debug/info", "s3cret")
+	if err = json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(rsp.Data["go_version"].(string), "go") || rsp.Data["goroutines"].(float64) <= 0 {
+		t.Fatalf("unexpected runtime info %v", rsp.Data)
+	}
+
+	w = get("127.0.0.1:1234", "/debug/config", "s3cret")
+	if body := w.Body.String(); strings.Contains(body, "s3cret") || !strings.Contains(body, "token: '******'") {
+		t.Fatalf("token should be masked in config dump:\n%s", body)
+	}
+
+	w = get("127.0.0.1:1234", "/debug/routes", "s3cret")
+	if body := w.Body.String(); !strings.Contains(body, `"default":[`) || !strings.Contains(body, `"path":"/hello"`) {
+		t.Fatalf("unexpected routes %s", body)
+	}
+
+	w = get("127.0.0.1:1234", "/debug/log", "s3cret")
+	if body := w.Body.String(); !strings.Contains(body, `"custom_logger":true`) {
+		t.Fatalf("unexpected log levels %s", body)
+	}
+
+	// 管理端口随服务一起启动
+	go func() {
+		_ = s.Start()
+	}()
+	defer s.Shutdown(context.Background())
+	for i := 0; i < 50 && admin.Addr() == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://"+admin.Addr().String()+"/debug/info", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	httpRsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpRsp.Body.Close()
+	if httpRsp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", httpRsp.StatusCode)
+	}
+}
+
+func TestAdminDisabled(t *testing.T) {
+	cfg, err := ParseConfig("otz_go.yaml", []byte("server:\n  ip: 127.0.0.1\n  port: 8080\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(WithConfig(cfg), WithLogger(logtest.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Admin().Register("/internal", func(ctx context.Context) {})
+	if err = s.Start(); err == nil || !strings.Contains(err.Error(), "admin server not enabled") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = ParseConfig("otz_go.yaml", []byte(`server:
+  admin:
+    address: 127.0.0.1:9091
+    allow_ips: [10.0.0.0/33]
+`))
+	if err == nil || !strings.Contains(err.Error(), `server.admin.allow_ips: invalid cidr "10.0.0.0/33"`) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -1,9 +1,14 @@
 package otz
 
 import (
+	"errors"
+	"fmt"
+	"github.com/ShadowsGtt/otz/log"
 	"gopkg.in/yaml.v3"
-	"io/ioutil"
+	"os"
+	"strings"
 	"sync/atomic"
+	"time"
 )
 
 // Config 本地配置
@@ -11,9 +16,51 @@ type Config struct {
 	Server struct {
 		Ip   string `yaml:"ip"`
 		Port int    `yaml:"port"`
+		// TraceHeader 请求携带该header且值为true时, 当前请求输出trace日志, 为空则不开启
+		TraceHeader string `yaml:"trace_header"`
+		// WatchConfig 是否监听配置文件变化并热加载
+		WatchConfig bool `yaml:"watch_config"`
+		// WatchInterval 配置文件检查间隔, 默认5s
+		WatchInterval time.Duration `yaml:"watch_interval"`
+		// StrictConfig 严格模式, 框架配置中出现未知的key时报错
+		StrictConfig bool `yaml:"strict_config"`
+		// HotRestart 收到SIGUSR2时热重启, 新进程继承监听的端口, 连接不中断
+		HotRestart bool `yaml:"hot_restart"`
+		// ShutdownTimeout 停止服务时等待处理中请求的最长时间, 默认30s
+		ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+		// TLS 默认服务的TLS配置, 配置services时在各服务中配置
+		TLS TLSConfig `yaml:"tls"`
+		// Transport 默认服务的协议及超时等参数, 配置services时在各服务中配置
+		Transport TransportConfig `yaml:"transport"`
+		// Timeout 请求处理超时, 支持全局及按路由配置
+		Timeout TimeoutConfig `yaml:"timeout"`
+		// Health 健康检查接口 /healthz /readyz /livez
+		Health HealthConfig `yaml:"health"`
+		// Metrics 请求指标, 在管理端口的 /metrics 暴露
+		Metrics MetricsConfig `yaml:"metrics"`
+		// Admin 管理端口, 提供pprof, 运行信息, 配置及路由查询等内部接口, address为空不开启
+		Admin AdminConfig `yaml:"admin"`
+		// Services 多个服务, 各自监听地址, 第一个为默认服务, 为空时使用ip和port作为默认服务
+		Services []ServiceConfig `yaml:"services"`
 	} `yaml:"server"`
 
 	Log yaml.Node `yaml:"log"`
+	// LogFields XxxCtx日志自动追加的字段, 可选 request_id user_id client_ip route 及自定义注册的提取器
+	// 自定义提取器需在加载配置前注册, 未注册的字段校验失败
+	LogFields []string `yaml:"log_fields"`
+	// LogEscalation 请求级日志等级提升, 命中签名header或规则的请求输出更低等级日志
+	LogEscalation log.EscalationConfig `yaml:"log_escalation"`
+	// LogWebhook error及以上日志的webhook告警, url为空不开启
+	LogWebhook log.WebhookConfig `yaml:"log_webhook"`
+	// Tracing OpenTelemetry链路追踪, exporter为空不开启
+	Tracing TracingConfig `yaml:"tracing"`
+
+	raw       yaml.Node             // 合并后的完整配置文档, 用于按路径比较及读取自定义配置
+	file      string                // 配置文件路径, 多个以逗号分隔
+	nodeFiles map[*yaml.Node]string // 配置节点所属文件, 用于错误提示
+	// secretNodes 引用了密钥的配置节点, Dump时脱敏
+	secretNodes map[*yaml.Node]bool
+	secrets     []secretRef
 }
 
 const (
@@ -25,21 +72,114 @@ var (
 	globalServerConfig     atomic.Value
 )
 
-// LoadConfig 加载服务配置
-func LoadConfig(filePath string) (*Config, error) {
-	// 解析配置文件
-	content, err := ioutil.ReadFile(filePath)
+// LoadConfig 加载服务配置, 多个配置按顺序深度合并, 后面的覆盖前面的
+// 配置地址按scheme选择ConfigProvider, 如 http://host/otz_go.yaml, 没有scheme时为本地文件
+// 按扩展名识别格式: .yaml/.yml/.json/.toml
+// 生效顺序: 默认值 -> 配置文件 -> ConfigEnvPrefix前缀的环境变量 -> GlobalConfigOverrides
+// 配置文件中可以使用 ${VAR} 或 ${VAR:-default} 引用环境变量
+// 及 ${secret:file:/run/secrets/db} 或 ${secret:env:DB_PASS} 引用密钥, 见RegisterSecretResolver
+// 加载后会校验配置, 错误为ConfigErrors, 包含文件中的行列位置
+func LoadConfig(uris ...string) (*Config, error) {
+	providers, err := newConfigProviders(uris)
 	if err != nil {
 		return nil, err
 	}
-	cfg := &Config{}
-	err = yaml.Unmarshal(content, cfg)
+	return LoadConfigFrom(providers...)
+}
+
+// LoadConfigFrom 从指定的配置来源加载服务配置, 同LoadConfig
+func LoadConfigFrom(providers ...ConfigProvider) (*Config, error) {
+	if len(providers) == 0 {
+		return nil, errors.New("no config file")
+	}
+	names := make([]string, 0, len(providers))
+	docs := make([]*yaml.Node, 0, len(providers))
+	for _, p := range providers {
+		// 解析配置文件
+		content, err := p.Load()
+		if err != nil {
+			return nil, err
+		}
+		doc, err := parseConfigFile(p.Name(), content)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, p.Name())
+		docs = append(docs, doc)
+	}
+	cfg, err := buildConfig(names, docs)
 	if err != nil {
 		return nil, err
 	}
+	if err = cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// ParseConfig 解析内存中的配置, name的扩展名决定格式, 如 otz_go.yaml, 常用于单测
+func ParseConfig(name string, content []byte) (*Config, error) {
+	return LoadConfigFrom(&memoryProvider{name: name, content: content})
+}
+
+// buildConfig 合并配置文档, 应用覆盖项后解码
+func buildConfig(filePaths []string, docs []*yaml.Node) (*Config, error) {
+	cfg := defaultConfig()
+	cfg.file = strings.Join(filePaths, ",")
+	cfg.nodeFiles = map[*yaml.Node]string{}
+	merged := &yaml.Node{}
+	for i, doc := range docs {
+		recordNodeFile(cfg.nodeFiles, doc, filePaths[i])
+		merged = mergeNode(merged, doc, ListMergeReplace)
+	}
+	cfg.raw = *merged
+	if err := applyEnvOverrides(&cfg.raw, ConfigEnvPrefix, os.Environ()); err != nil {
+		return nil, err
+	}
+	if err := applyOverrides(&cfg.raw, GlobalConfigOverrides); err != nil {
+		return nil, err
+	}
+	if err := cfg.resolveSecrets(); err != nil {
+		return nil, err
+	}
+	// 空文件且没有覆盖项
+	if cfg.raw.Kind == 0 {
+		return cfg, nil
+	}
+	if err := cfg.raw.Decode(cfg); err != nil {
+		return nil, wrapDecodeError("override", err, cfg.secretNodes)
+	}
 	return cfg, nil
 }
 
+// serviceConfigs 服务列表, 未配置时使用ip和port
+func (c *Config) serviceConfigs() []ServiceConfig {
+	if len(c.Server.Services) > 0 {
+		return c.Server.Services
+	}
+	return []ServiceConfig{{
+		Name:      defaultServiceName,
+		Network:   NetworkTCP,
+		Address:   fmt.Sprintf("%s:%d", c.Server.Ip, c.Server.Port),
+		TLS:       c.Server.TLS,
+		Transport: c.Server.Transport,
+	}}
+}
+
+// lookupNode 按路径查找配置节点, 如 server.port, 不存在返回nil
+func (c *Config) lookupNode(keyPath string) *yaml.Node {
+	node := rootMapping(&c.raw)
+	if keyPath == "" || node == nil {
+		return node
+	}
+	for _, key := range strings.Split(keyPath, ".") {
+		if node = mappingValue(node, key); node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
 // SetGlobalConfig 存储到全局变量
 func SetGlobalConfig(cfg *Config) {
 	globalServerConfig.Store(cfg)
@@ -0,0 +1,189 @@
+package otz
+
+import (
+	"fmt"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ListMergeStrategy 多个配置文件合并时列表的合并策略
+// 在覆盖文件的列表上使用yaml tag指定, 如 log: !append [...], 未指定时为replace
+type ListMergeStrategy string
+
+const (
+	ListMergeReplace ListMergeStrategy = "!replace" // 替换整个列表
+	ListMergeAppend  ListMergeStrategy = "!append"  // 追加到列表末尾
+	ListMergeIndex   ListMergeStrategy = "!merge"   // 按下标深度合并, 多出的元素追加
+)
+
+const maskedValue = "******"
+
+// secretKeyPattern 输出配置时需要脱敏的key
+var secretKeyPattern = regexp.MustCompile(`(?i)(password|passwd|secret|token|credential|private_key|access_key)`)
+
+// parseConfigFile 按扩展名解析配置文件为yaml文档, 并检查能否解码
+func parseConfigFile(filePath string, content []byte) (*yaml.Node, error) {
+	doc := &yaml.Node{}
+	switch ext := configExt(filePath); ext {
+	case ".yaml", ".yml", ".json", "":
+		// json是yaml的子集, 直接使用yaml解析以保留行列号
+		if err := yaml.Unmarshal(content, doc); err != nil {
+			return nil, wrapDecodeError(filePath, err, nil)
+		}
+	case ".toml":
+		m := map[string]interface{}{}
+		if err := toml.Unmarshal(content, &m); err != nil {
+			return nil, &ConfigError{File: filePath, Msg: err.Error()}
+		}
+		root := &yaml.Node{}
+		if err := root.Encode(m); err != nil {
+			return nil, &ConfigError{File: filePath, Msg: err.Error()}
+		}
+		doc = &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{root}}
+	default:
+		return nil, &ConfigError{File: filePath, Msg: fmt.Sprintf("unsupported config format %s", ext)}
+	}
+	expandEnv(doc)
+	// 单独解码一次, 类型错误可以定位到具体文件, 密钥引用在解析后校验
+	if doc.Kind != 0 {
+		if err := skipSecretRefs(doc).Decode(defaultConfig()); err != nil {
+			return nil, wrapDecodeError(filePath, err, nil)
+		}
+	}
+	return doc, nil
+}
+
+// configExt 配置格式扩展名, url忽略参数部分
+func configExt(name string) string {
+	if strings.Contains(name, "://") {
+		if u, err := url.Parse(name); err == nil {
+			name = u.Path
+		}
+	}
+	return strings.ToLower(path.Ext(filepath.ToSlash(name)))
+}
+
+// recordNodeFile 记录文档中所有节点所属的文件
+func recordNodeFile(nodeFiles map[*yaml.Node]string, node *yaml.Node, file string) {
+	nodeFiles[node] = file
+	for _, child := range node.Content {
+		recordNodeFile(nodeFiles, child, file)
+	}
+}
+
+// mergeNode 将src深度合并到dst, 返回合并后的节点
+// mapping按key合并, 列表按src上的tag指定的策略合并, 其余使用src替换
+// 替换时返回src节点本身而不是复制内容, 保证节点位置信息与所属文件一致
+func mergeNode(dst, src *yaml.Node, strategy ListMergeStrategy) *yaml.Node {
+	if src.Kind == yaml.SequenceNode && isListMergeTag(src.Tag) {
+		strategy = ListMergeStrategy(src.Tag)
+		src.Tag = "!!seq"
+	}
+	switch {
+	case src.Kind == 0:
+		// 空文件
+		return dst
+	case dst.Kind == 0:
+		stripListMergeTags(src)
+		return src
+	case dst.Kind == yaml.DocumentNode && src.Kind == yaml.DocumentNode:
+		if len(dst.Content) == 0 || len(src.Content) == 0 {
+			return mergeNode(&yaml.Node{}, src, strategy)
+		}
+		dst.Content[0] = mergeNode(dst.Content[0], src.Content[0], ListMergeReplace)
+		return dst
+	case dst.Kind == yaml.MappingNode && src.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(src.Content); i += 2 {
+			key, value := src.Content[i], src.Content[i+1]
+			merged := false
+			for j := 0; j+1 < len(dst.Content); j += 2 {
+				if dst.Content[j].Value == key.Value {
+					dst.Content[j+1] = mergeNode(dst.Content[j+1], value, ListMergeReplace)
+					merged = true
+					break
+				}
+			}
+			if !merged {
+				stripListMergeTags(value)
+				dst.Content = append(dst.Content, key, value)
+			}
+		}
+		return dst
+	case dst.Kind == yaml.SequenceNode && src.Kind == yaml.SequenceNode && strategy == ListMergeAppend:
+		stripListMergeTags(src)
+		dst.Content = append(dst.Content, src.Content...)
+		return dst
+	case dst.Kind == yaml.SequenceNode && src.Kind == yaml.SequenceNode && strategy == ListMergeIndex:
+		for i, item := range src.Content {
+			if i < len(dst.Content) {
+				dst.Content[i] = mergeNode(dst.Content[i], item, ListMergeReplace)
+				continue
+			}
+			stripListMergeTags(item)
+			dst.Content = append(dst.Content, item)
+		}
+		return dst
+	default:
+		stripListMergeTags(src)
+		return src
+	}
+}
+
+func isListMergeTag(tag string) bool {
+	switch ListMergeStrategy(tag) {
+	case ListMergeReplace, ListMergeAppend, ListMergeIndex:
+		return true
+	}
+	return false
+}
+
+// stripListMergeTags 去掉未参与合并的节点上的合并tag, 避免影响解码
+func stripListMergeTags(node *yaml.Node) {
+	if node.Kind == yaml.SequenceNode && isListMergeTag(node.Tag) {
+		node.Tag = "!!seq"
+	}
+	for _, child := range node.Content {
+		stripListMergeTags(child)
+	}
+}
+
+// Dump 输出生效的完整配置(合并及覆盖后), 敏感配置及密钥引用已脱敏, 用于排查问题
+func (c *Config) Dump() string {
+	root := rootMapping(&c.raw)
+	if root == nil {
+		return ""
+	}
+	masked := maskNode(root, false, c.secretNodes)
+	out, err := yaml.Marshal(masked)
+	if err != nil {
+		return err.Error()
+	}
+	return string(out)
+}
+
+// maskNode 复制节点, 敏感key对应的值及密钥引用替换为******
+func maskNode(node *yaml.Node, secret bool, secretNodes map[*yaml.Node]bool) *yaml.Node {
+	copied := *node
+	if node.Kind == yaml.ScalarNode {
+		if (secret || secretNodes[node]) && node.Value != "" {
+			copied.Value = maskedValue
+			copied.Tag = "!!str"
+			copied.Style = 0
+		}
+		return &copied
+	}
+	copied.Content = make([]*yaml.Node, 0, len(node.Content))
+	for i, child := range node.Content {
+		childSecret := secret
+		if node.Kind == yaml.MappingNode && i%2 == 1 {
+			childSecret = secret || secretKeyPattern.MatchString(node.Content[i-1].Value)
+		}
+		copied.Content = append(copied.Content, maskNode(child, childSecret, secretNodes))
+	}
+	return &copied
+}
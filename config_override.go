@@ -0,0 +1,241 @@
+package otz
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// 配置生效顺序: 默认值 -> 配置文件 -> 环境变量 -> 命令行 -set
+var (
+	// ConfigEnvPrefix 环境变量覆盖配置的前缀, 如 OTZ_SERVER_PORT 覆盖 server.port, 为空不开启
+	ConfigEnvPrefix = "OTZ_"
+	// GlobalConfigOverrides 命令行 -set key.path=value 覆盖配置, 可重复指定, 优先级最高
+	GlobalConfigOverrides []string
+)
+
+// envRefPattern 配置文件中的环境变量引用 ${VAR} 或 ${VAR:-default}
+var envRefPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// overrideFlag -set 命令行参数
+type overrideFlag []string
+
+// String flag.Value
+func (f *overrideFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+// Set flag.Value
+func (f *overrideFlag) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("invalid override %q, expect key.path=value", value)
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+// defaultConfig 默认配置
+func defaultConfig() *Config {
+	cfg := &Config{}
+	cfg.Server.Ip = "0.0.0.0"
+	cfg.Server.Port = 8080
+	cfg.Server.WatchInterval = defaultWatchInterval
+	cfg.Server.Health.ShutdownDelay = defaultShutdownDelay
+	return cfg
+}
+
+// expandEnv 展开文档中值的 ${VAR} 及 ${VAR:-default}, 变量未设置或为空时使用默认值
+// 解析后按值替换, 变量中的yaml特殊字符(如 * : #)不影响解析
+func expandEnv(node *yaml.Node) {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			expandEnv(child)
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			expandEnv(node.Content[i])
+		}
+	case yaml.ScalarNode:
+		if !envRefPattern.MatchString(node.Value) {
+			return
+		}
+		node.Value = envRefPattern.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			m := envRefPattern.FindStringSubmatch(ref)
+			value, ok := os.LookupEnv(m[1])
+			if (!ok || value == "") && m[2] != "" {
+				return m[3]
+			}
+			return value
+		})
+		resolveScalarTag(node)
+	}
+}
+
+// resolveScalarTag 值替换后重新识别plain值的类型, 使引用可以用于数字, 布尔及时长等配置
+// 带引号或显式指定tag的值保持原类型, 识别为null时仍作为字符串
+func resolveScalarTag(node *yaml.Node) {
+	if node.Style&(yaml.TaggedStyle|yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+		return
+	}
+	tag := (&yaml.Node{Kind: yaml.ScalarNode, Value: node.Value}).ShortTag()
+	if tag == "!!null" {
+		tag = "!!str"
+	}
+	node.Tag = tag
+}
+
+// applyEnvOverrides 使用带前缀的环境变量覆盖配置
+// 变量名去掉前缀后按 _ 切分, 优先匹配已知的配置项(如 trace_header), 未知部分逐级嵌套
+func applyEnvOverrides(doc *yaml.Node, prefix string, environ []string) error {
+	if prefix == "" {
+		return nil
+	}
+	// 排序保证多个变量命中同一配置时结果稳定
+	sort.Strings(environ)
+	for _, kv := range environ {
+		idx := strings.IndexByte(kv, '=')
+		if idx == -1 || !strings.HasPrefix(kv[:idx], prefix) {
+			continue
+		}
+		if kv[:idx] == envInheritListeners || kv[:idx] == envReadyFD {
+			// 修改ConfigEnvPrefix后仍可能与热重启的环境变量同前缀
+			continue
+		}
+		name := strings.ToLower(strings.TrimPrefix(kv[:idx], prefix))
+		if name == "" {
+			continue
+		}
+		keyPath := envKeyPath(rootMapping(doc), reflect.TypeOf(Config{}), strings.Split(name, "_"))
+		if err := setNodeValue(doc, keyPath, kv[idx+1:]); err != nil {
+			return fmt.Errorf("invalid env %s: %v", kv[:idx], err)
+		}
+	}
+	return nil
+}
+
+// applyOverrides 使用 key.path=value 覆盖配置
+func applyOverrides(doc *yaml.Node, overrides []string) error {
+	for _, o := range overrides {
+		idx := strings.IndexByte(o, '=')
+		if idx <= 0 {
+			return fmt.Errorf("invalid override %q, expect key.path=value", o)
+		}
+		if err := setNodeValue(doc, strings.Split(o[:idx], "."), o[idx+1:]); err != nil {
+			return fmt.Errorf("invalid override %q: %v", o, err)
+		}
+	}
+	return nil
+}
+
+// envKeyPath 将环境变量切分后的单词还原为配置路径
+func envKeyPath(node *yaml.Node, typ reflect.Type, words []string) []string {
+	if len(words) == 0 {
+		return nil
+	}
+	known := knownKeys(node, typ)
+	// 优先匹配最长的已知key
+	for n := len(words); n > 0; n-- {
+		key := strings.Join(words[:n], "_")
+		if childTyp, ok := known[key]; ok {
+			return append([]string{key}, envKeyPath(mappingValue(node, key), childTyp, words[n:])...)
+		}
+	}
+	return append([]string{words[0]}, envKeyPath(mappingValue(node, words[0]), nil, words[1:])...)
+}
+
+// knownKeys 当前层级已知的key, 包括配置文件中的key及结构体的yaml tag
+func knownKeys(node *yaml.Node, typ reflect.Type) map[string]reflect.Type {
+	keys := map[string]reflect.Type{}
+	if node != nil && node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keys[node.Content[i].Value] = nil
+		}
+	}
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil || typ.Kind() != reflect.Struct {
+		return keys
+	}
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		tag := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		keys[tag] = f.Type
+	}
+	return keys
+}
+
+func rootMapping(doc *yaml.Node) *yaml.Node {
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		return doc.Content[0]
+	}
+	return nil
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// setNodeValue 按路径设置配置, 中间层级不存在时自动创建
+// value按yaml解析, 如 8080 为整数, [a, b] 为列表
+func setNodeValue(doc *yaml.Node, keyPath []string, value string) error {
+	valueDoc := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte(value), valueDoc); err != nil {
+		return err
+	}
+	valueNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null"}
+	if len(valueDoc.Content) > 0 {
+		valueNode = valueDoc.Content[0]
+	}
+	if doc.Kind != yaml.DocumentNode {
+		doc.Kind = yaml.DocumentNode
+	}
+	if len(doc.Content) == 0 {
+		doc.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+	}
+	node := doc.Content[0]
+	for i, key := range keyPath {
+		if node.Kind != yaml.MappingNode {
+			return fmt.Errorf("%s is not a mapping", strings.Join(keyPath[:i], "."))
+		}
+		// 替换节点而不是修改原节点, 原节点位置信息属于配置文件
+		idx := -1
+		for j := 0; j+1 < len(node.Content); j += 2 {
+			if node.Content[j].Value == key {
+				idx = j + 1
+				break
+			}
+		}
+		if idx == -1 {
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, nil)
+			idx = len(node.Content) - 1
+		}
+		if i == len(keyPath)-1 {
+			node.Content[idx] = valueNode
+			return nil
+		}
+		next := node.Content[idx]
+		if next == nil || next.Kind == yaml.ScalarNode && next.Tag == "!!null" {
+			next = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			node.Content[idx] = next
+		}
+		node = next
+	}
+	return nil
+}
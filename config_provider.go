@@ -0,0 +1,259 @@
+package otz
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConfigProvider 配置来源, 默认为本地文件, 可以扩展为配置中心(etcd, consul等)
+type ConfigProvider interface {
+	// Name 配置来源名称, 如文件路径或url, 用于错误提示及按扩展名识别格式
+	Name() string
+	// Load 读取完整的配置内容
+	Load() ([]byte, error)
+	// Watch 监听配置变化, 变化时回调onChange, 返回停止监听函数
+	Watch(interval time.Duration, onChange func()) (stop func())
+}
+
+// ConfigProviderFactory 根据配置地址创建ConfigProvider
+type ConfigProviderFactory func(uri string) (ConfigProvider, error)
+
+var (
+	configProviders = map[string]ConfigProviderFactory{
+		"file": func(uri string) (ConfigProvider, error) {
+			return NewFileProvider(strings.TrimPrefix(uri, "file://")), nil
+		},
+		"http": func(uri string) (ConfigProvider, error) {
+			return NewHTTPProvider(uri), nil
+		},
+		"https": func(uri string) (ConfigProvider, error) {
+			return NewHTTPProvider(uri), nil
+		},
+	}
+	configProviderMutex sync.RWMutex
+)
+
+// RegisterConfigProvider 注册scheme对应的配置来源, -conf etcd://... 即使用etcd注册的provider
+func RegisterConfigProvider(scheme string, factory ConfigProviderFactory) {
+	configProviderMutex.Lock()
+	defer configProviderMutex.Unlock()
+	configProviders[scheme] = factory
+}
+
+// NewConfigProvider 按地址的scheme创建ConfigProvider, 没有scheme时为本地文件
+func NewConfigProvider(uri string) (ConfigProvider, error) {
+	scheme := "file"
+	if idx := strings.Index(uri, "://"); idx > 0 {
+		scheme = uri[:idx]
+	}
+	configProviderMutex.RLock()
+	factory, ok := configProviders[scheme]
+	configProviderMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown config provider %s of %s", scheme, uri)
+	}
+	return factory(uri)
+}
+
+// FileProvider 本地文件配置
+type FileProvider struct {
+	path string
+}
+
+// NewFileProvider 创建本地文件配置
+func NewFileProvider(path string) *FileProvider {
+	return &FileProvider{path: path}
+}
+
+// Name 文件路径
+func (p *FileProvider) Name() string {
+	return p.path
+}
+
+// Load 读取文件
+func (p *FileProvider) Load() ([]byte, error) {
+	return ioutil.ReadFile(p.path)
+}
+
+// Watch 轮询文件, 不依赖inotify, 对挂载的配置卷同样适用
+func (p *FileProvider) Watch(interval time.Duration, onChange func()) (stop func()) {
+	state := &fileState{}
+	state.update(p.path)
+	return pollConfig(interval, func() bool {
+		return state.update(p.path)
+	}, onChange)
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+	hash    [sha256.Size]byte
+}
+
+// update 文件是否变化, 先比较修改时间和大小, 再比较内容
+func (f *fileState) update(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return false
+	}
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	hash := sha256.Sum256(content)
+	if hash == f.hash {
+		return false
+	}
+	f.hash = hash
+	return true
+}
+
+// memoryProvider 内存中的配置, 不会变化
+type memoryProvider struct {
+	name    string
+	content []byte
+}
+
+func (p *memoryProvider) Name() string {
+	return p.name
+}
+
+func (p *memoryProvider) Load() ([]byte, error) {
+	return p.content, nil
+}
+
+func (p *memoryProvider) Watch(time.Duration, func()) (stop func()) {
+	return func() {}
+}
+
+// HTTPProvider 通过http拉取配置, 使用ETag避免重复传输, 服务端返回304时使用缓存内容
+type HTTPProvider struct {
+	URL    string
+	Client *http.Client
+	Header http.Header // 额外的请求头, 如鉴权
+
+	mutex   sync.Mutex
+	etag    string
+	content []byte
+}
+
+// NewHTTPProvider 创建http配置
+func NewHTTPProvider(url string) *HTTPProvider {
+	return &HTTPProvider{
+		URL:    url,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Name url
+func (p *HTTPProvider) Name() string {
+	return p.URL
+}
+
+// Load 拉取配置
+func (p *HTTPProvider) Load() ([]byte, error) {
+	content, _, err := p.fetch()
+	return content, err
+}
+
+// Watch 定时拉取配置, 内容变化时回调
+func (p *HTTPProvider) Watch(interval time.Duration, onChange func()) (stop func()) {
+	return pollConfig(interval, func() bool {
+		_, changed, err := p.fetch()
+		return err == nil && changed
+	}, onChange)
+}
+
+// fetch 拉取配置, 返回最新内容及是否变化
+func (p *HTTPProvider) fetch() ([]byte, bool, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	req, err := http.NewRequest(http.MethodGet, p.URL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	for k, v := range p.Header {
+		req.Header[k] = v
+	}
+	if p.etag != "" && p.content != nil {
+		req.Header.Set("If-None-Match", p.etag)
+	}
+	rsp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rsp.Body.Close()
+	switch rsp.StatusCode {
+	case http.StatusNotModified:
+		return p.content, false, nil
+	case http.StatusOK:
+	default:
+		return nil, false, fmt.Errorf("fetch config %s failed, status: %s", p.URL, rsp.Status)
+	}
+	content, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	// 服务端不支持ETag时比较内容
+	changed := p.content == nil || !bytes.Equal(content, p.content)
+	p.etag = rsp.Header.Get("ETag")
+	p.content = content
+	return content, changed, nil
+}
+
+// pollConfig 定时调用changed检查配置, 变化时回调onChange
+func pollConfig(interval time.Duration, changed func() bool, onChange func()) (stop func()) {
+	if interval <= 0 {
+		interval = defaultWatchInterval
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if changed() {
+					onChange()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+}
+
+// newConfigProviders 将配置地址转换为ConfigProvider
+func newConfigProviders(uris []string) ([]ConfigProvider, error) {
+	if len(uris) == 0 {
+		return nil, errors.New("no config file")
+	}
+	providers := make([]ConfigProvider, 0, len(uris))
+	for _, uri := range uris {
+		p, err := NewConfigProvider(uri)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, p)
+	}
+	return providers, nil
+}
@@ -0,0 +1,265 @@
+package otz
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SecretResolver 解析配置中的密钥引用 ${secret:scheme:ref}, 如从文件, 环境变量或vault读取
+type SecretResolver interface {
+	Resolve(ref string) (string, error)
+}
+
+// SecretResolverFunc 函数形式的SecretResolver
+type SecretResolverFunc func(ref string) (string, error)
+
+// Resolve SecretResolver
+func (f SecretResolverFunc) Resolve(ref string) (string, error) {
+	return f(ref)
+}
+
+// secretRefPattern 配置值中的密钥引用 ${secret:file:/run/secrets/db} 或 ${secret:env:DB_PASS}
+var secretRefPattern = regexp.MustCompile(`\$\{secret:([A-Za-z0-9_-]+):([^}]*)\}`)
+
+var (
+	secretResolvers = map[string]SecretResolver{
+		"file": SecretResolverFunc(resolveFileSecret),
+		"env":  SecretResolverFunc(resolveEnvSecret),
+	}
+	secretResolverMutex sync.RWMutex
+)
+
+// RegisterSecretResolver 注册scheme对应的SecretResolver, 已存在时覆盖
+func RegisterSecretResolver(scheme string, resolver SecretResolver) {
+	secretResolverMutex.Lock()
+	defer secretResolverMutex.Unlock()
+	secretResolvers[scheme] = resolver
+}
+
+// resolveFileSecret 读取文件内容, 去掉末尾换行, 适用于docker/k8s挂载的secret
+func resolveFileSecret(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+func resolveEnvSecret(name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("env %s not set", name)
+	}
+	return value, nil
+}
+
+// Secret 密钥类型的配置, 打印及序列化时脱敏, 使用Value获取原始值
+type Secret string
+
+// Value 原始值
+func (s Secret) Value() string {
+	return string(s)
+}
+
+// String 脱敏, 避免通过日志泄露
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return maskedValue
+}
+
+// GoString %#v 同样脱敏
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+// MarshalJSON 脱敏
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + s.String() + `"`), nil
+}
+
+// secretRef 配置中解析过的密钥引用, 用于热加载时检查密钥是否轮换
+type secretRef struct {
+	scheme string
+	ref    string
+	value  string
+}
+
+// resolveSecrets 解析配置中所有密钥引用, 解析后的节点在Dump中脱敏
+func (c *Config) resolveSecrets() error {
+	c.secretNodes = map[*yaml.Node]bool{}
+	errs := ConfigErrors{}
+	var walk func(node *yaml.Node, path string)
+	walk = func(node *yaml.Node, path string) {
+		switch node.Kind {
+		case yaml.DocumentNode, yaml.SequenceNode:
+			for i, child := range node.Content {
+				childPath := path
+				if node.Kind == yaml.SequenceNode {
+					childPath = fmt.Sprintf("%s[%d]", path, i)
+				}
+				walk(child, childPath)
+			}
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				childPath := node.Content[i].Value
+				if path != "" {
+					childPath = path + "." + childPath
+				}
+				walk(node.Content[i+1], childPath)
+			}
+		case yaml.ScalarNode:
+			if !strings.Contains(node.Value, "${secret:") {
+				return
+			}
+			value, err := c.resolveValue(node.Value)
+			if err != nil {
+				e := &ConfigError{File: "override", Path: path, Msg: err.Error()}
+				if file, ok := c.nodeFiles[node]; ok {
+					e.File, e.Line, e.Column = file, node.Line, node.Column
+				}
+				errs = append(errs, e)
+				return
+			}
+			node.Value = value
+			// 按密钥的值重新识别类型, 可以用于数字, 布尔及时长等配置
+			resolveScalarTag(node)
+			c.secretNodes[node] = true
+		}
+	}
+	walk(&c.raw, "")
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// resolveValue 替换值中的密钥引用, 错误信息中不包含密钥
+func (c *Config) resolveValue(value string) (string, error) {
+	var resolveErr error
+	resolved := secretRefPattern.ReplaceAllStringFunc(value, func(ref string) string {
+		m := secretRefPattern.FindStringSubmatch(ref)
+		secretResolverMutex.RLock()
+		resolver, ok := secretResolvers[m[1]]
+		secretResolverMutex.RUnlock()
+		if !ok {
+			resolveErr = fmt.Errorf("unknown secret resolver %s", m[1])
+			return ""
+		}
+		secret, err := resolver.Resolve(m[2])
+		if err != nil {
+			resolveErr = fmt.Errorf("resolve secret %s:%s failed: %v", m[1], m[2], err)
+			return ""
+		}
+		c.secrets = append(c.secrets, secretRef{scheme: m[1], ref: m[2], value: secret})
+		return secret
+	})
+	if resolveErr != nil {
+		return "", resolveErr
+	}
+	return resolved, nil
+}
+
+// skipSecretRefs 复制文档, 密钥引用替换为null, 用于解析密钥前检查其他配置的类型
+func skipSecretRefs(node *yaml.Node) *yaml.Node {
+	copied := *node
+	if node.Kind == yaml.ScalarNode && strings.Contains(node.Value, "${secret:") {
+		copied.Tag, copied.Value, copied.Style = "!!null", "", 0
+		return &copied
+	}
+	copied.Content = make([]*yaml.Node, 0, len(node.Content))
+	for _, child := range node.Content {
+		copied.Content = append(copied.Content, skipSecretRefs(child))
+	}
+	return &copied
+}
+
+// redactSecrets 按行号脱敏yaml解码错误, 错误所在行有引用了密钥的配置时将错误中的值替换为******
+// 解码错误格式为 line N: cannot unmarshal !!tag `value` into type, 每行一个错误
+func redactSecrets(msg string, secretNodes map[*yaml.Node]bool) string {
+	if len(secretNodes) == 0 {
+		return msg
+	}
+	lines := strings.Split(msg, "\n")
+	for i, line := range lines {
+		m := yamlErrLinePattern.FindStringSubmatch(strings.TrimLeft(strings.TrimPrefix(line, "yaml: "), " "))
+		if m == nil {
+			continue
+		}
+		lineNo, _ := strconv.Atoi(m[1])
+		for node := range secretNodes {
+			if node.Line != lineNo {
+				continue
+			}
+			// 值中可能包含`, 取第一个和最后一个`之间的部分
+			if begin, end := strings.IndexByte(line, '`'), strings.LastIndexByte(line, '`'); begin < end {
+				lines[i] = line[:begin+1] + maskedValue + line[end:]
+			}
+			break
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// maskedArg 脱敏后的格式化参数, 任意格式都输出******
+type maskedArg struct{}
+
+// Format fmt.Formatter
+func (maskedArg) Format(f fmt.State, verb rune) {
+	_, _ = f.Write([]byte(maskedValue))
+}
+
+// redactSecretArgs 校验错误的参数中包含node及其子节点引用的密钥时替换为******
+func redactSecretArgs(node *yaml.Node, secretNodes map[*yaml.Node]bool, args []interface{}) []interface{} {
+	var values []string
+	var walk func(n *yaml.Node)
+	walk = func(n *yaml.Node) {
+		if secretNodes[n] && n.Value != "" {
+			values = append(values, n.Value)
+		}
+		for _, child := range n.Content {
+			walk(child)
+		}
+	}
+	if node != nil {
+		walk(node)
+	}
+	if len(values) == 0 {
+		return args
+	}
+	redacted := make([]interface{}, len(args))
+	for i, arg := range args {
+		redacted[i] = arg
+		s := fmt.Sprint(arg)
+		for _, value := range values {
+			if strings.Contains(s, value) {
+				redacted[i] = maskedArg{}
+				break
+			}
+		}
+	}
+	return redacted
+}
+
+// secretsChanged 配置中引用的密钥是否已轮换, 用于热加载
+func (c *Config) secretsChanged() bool {
+	for _, s := range c.secrets {
+		secretResolverMutex.RLock()
+		resolver, ok := secretResolvers[s.scheme]
+		secretResolverMutex.RUnlock()
+		if !ok {
+			continue
+		}
+		if value, err := resolver.Resolve(s.ref); err == nil && value != s.value {
+			return true
+		}
+	}
+	return false
+}
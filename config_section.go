@@ -0,0 +1,140 @@
+package otz
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type sectionKey struct {
+	name string
+	typ  reflect.Type
+}
+
+type sectionEntry struct {
+	cfg   *Config // 解码时的全局配置, 配置热加载后失效
+	value interface{}
+}
+
+var (
+	sections     = map[sectionKey]*sectionEntry{}
+	sectionMutex sync.Mutex
+)
+
+// ConfigSection 将配置文件中的顶层配置name解码为T, 如 ConfigSection[RedisConfig]("redis")
+// 先应用字段tag default:"..." 中的默认值, 再使用配置覆盖, 配置不存在时只有默认值
+// 结果按name和T缓存, 全局配置被替换(如热加载)后重新解码, 返回值不要修改
+func ConfigSection[T any](name string) (*T, error) {
+	cfg := GetGlobalConfig()
+	key := sectionKey{name: name, typ: reflect.TypeOf((*T)(nil)).Elem()}
+
+	sectionMutex.Lock()
+	defer sectionMutex.Unlock()
+	if entry, ok := sections[key]; ok && entry.cfg == cfg {
+		return entry.value.(*T), nil
+	}
+	value, err := decodeSection[T](cfg, name)
+	if err != nil {
+		return nil, err
+	}
+	sections[key] = &sectionEntry{cfg: cfg, value: value}
+	return value, nil
+}
+
+func decodeSection[T any](cfg *Config, name string) (*T, error) {
+	value := new(T)
+	if err := setDefaults(reflect.ValueOf(value).Elem()); err != nil {
+		return nil, fmt.Errorf("config section %s: %v", name, err)
+	}
+	node := cfg.lookupNode(name)
+	if node == nil {
+		return value, nil
+	}
+	if err := node.Decode(value); err != nil {
+		return nil, fmt.Errorf("config section %s: %s", name, redactSecrets(err.Error(), cfg.secretNodes))
+	}
+	return value, nil
+}
+
+// setDefaults 为零值字段设置tag default:"..." 中的默认值, 递归处理嵌套结构体
+func setDefaults(v reflect.Value) error {
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		if !field.CanSet() {
+			continue
+		}
+		if field.Kind() == reflect.Struct {
+			if err := setDefaults(field); err != nil {
+				return err
+			}
+			continue
+		}
+		def, ok := t.Field(i).Tag.Lookup("default")
+		if !ok || !field.IsZero() {
+			continue
+		}
+		if err := setValue(field, def); err != nil {
+			return fmt.Errorf("invalid default of %s: %v", t.Field(i).Name, err)
+		}
+	}
+	return nil
+}
+
+func setValue(field reflect.Value, value string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		// 逗号分隔
+		items := strings.Split(value, ",")
+		slice := reflect.MakeSlice(field.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setValue(slice.Index(i), strings.TrimSpace(item)); err != nil {
+				return err
+			}
+		}
+		field.Set(slice)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
@@ -0,0 +1,619 @@
+package otz
+
+import (
+	"fmt"
+	"github.com/ShadowsGtt/otz/log/logtest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "otz_go.yaml")
+	writeConfig(t, path, "server:\n  port: 8080\n")
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetGlobalConfig(cfg)
+
+	portChanged := make(chan int, 1)
+	unsubscribe := Subscribe("server.port", func(oldCfg, newCfg *Config) {
+		portChanged <- newCfg.Server.Port
+	})
+	defer unsubscribe()
+	logChanged := make(chan struct{}, 1)
+	defer Subscribe("log", func(oldCfg, newCfg *Config) {
+		logChanged <- struct{}{}
+	})()
+
+	stop := WatchConfig(10*time.Millisecond, NewFileProvider(path))
+	defer stop()
+
+	// 只有端口变化
+	writeConfig(t, path, "server:\n  port: 9090\n")
+	select {
+	case port := <-portChanged:
+		if port != 9090 || GetGlobalConfig().Server.Port != 9090 {
+			t.Fatalf("unexpected port: %d", port)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("port change not notified")
+	}
+	select {
+	case <-logChanged:
+		t.Fatal("log subscriber should not be notified")
+	default:
+	}
+
+	// 非法配置不生效
+	writeConfig(t, path, "server:\n  port: [\n")
+	time.Sleep(100 * time.Millisecond)
+	if GetGlobalConfig().Server.Port != 9090 {
+		t.Fatalf("invalid config should be rejected, port: %d", GetGlobalConfig().Server.Port)
+	}
+	writeConfig(t, path, "server:\n  port: 9090\nlog: not_a_list\n")
+	time.Sleep(100 * time.Millisecond)
+	if GetGlobalConfig().lookupNode("log") != nil {
+		t.Fatal("invalid log config should be rejected")
+	}
+	writeConfig(t, path, "server:\n  port: 9090\nlog_fields: [no_such_extractor]\n")
+	time.Sleep(100 * time.Millisecond)
+	if len(GetGlobalConfig().LogFields) != 0 {
+		t.Fatal("unknown log field extractor should be rejected")
+	}
+}
+
+func TestConfigOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "otz_go.yaml")
+	writeConfig(t, path, `
+server:
+  port: 8000
+  watch_interval: ${WATCH_INTERVAL:-3s}
+redis:
+  addr: ${REDIS_HOST:-127.0.0.1}:${REDIS_PORT:-6379}
+  password: ${REDIS_PASSWORD}
+  db_pass: ${DB_PASS}
+  quoted: "${REDIS_PORT:-6379}"
+`)
+	t.Setenv("REDIS_HOST", "10.0.0.1")
+	// 值中的yaml特殊字符不影响解析
+	t.Setenv("DB_PASS", "*a: b")
+	t.Setenv("OTZ_SERVER_PORT", "9000")
+	t.Setenv("OTZ_SERVER_TRACE_HEADER", "X-Trace")
+	t.Setenv("OTZ_LOG_FIELDS", "[request_id, route]")
+	t.Setenv("OTZ_REDIS_DB", "2")
+	GlobalConfigOverrides = []string{"server.port=9100", "redis.pool.size=10"}
+	defer func() {
+		GlobalConfigOverrides = nil
+	}()
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 命令行优先级高于环境变量, 环境变量高于配置文件
+	if cfg.Server.Port != 9100 {
+		t.Fatalf("unexpected port: %d", cfg.Server.Port)
+	}
+	if cfg.Server.Ip != "0.0.0.0" {
+		t.Fatalf("default ip not applied: %s", cfg.Server.Ip)
+	}
+	if cfg.Server.WatchInterval != 3*time.Second {
+		t.Fatalf("env reference should decode as duration: %s", cfg.Server.WatchInterval)
+	}
+	if cfg.Server.TraceHeader != "X-Trace" {
+		t.Fatalf("unexpected trace header: %s", cfg.Server.TraceHeader)
+	}
+	if len(cfg.LogFields) != 2 || cfg.LogFields[1] != "route" {
+		t.Fatalf("unexpected log fields: %v", cfg.LogFields)
+	}
+	for keyPath, want := range map[string]string{
+		"redis.addr":      "10.0.0.1:6379",
+		"redis.password":  "",
+		"redis.db_pass":   "*a: b",
+		"redis.db":        "2",
+		"redis.pool.size": "10",
+	} {
+		node := cfg.lookupNode(keyPath)
+		if node == nil || node.Value != want {
+			t.Fatalf("unexpected %s: %v", keyPath, node)
+		}
+	}
+
+	if node := cfg.lookupNode("redis.quoted"); node.Value != "6379" || node.ShortTag() != "!!str" {
+		t.Fatalf("quoted env reference should stay string: %v", node)
+	}
+
+	if err = applyOverrides(&cfg.raw, []string{"server.port.x=1"}); err == nil {
+		t.Fatal("override scalar as mapping should fail")
+	}
+}
+
+func TestConfigIgnoreRestartEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "otz_go.yaml")
+	writeConfig(t, path, "server:\n  port: 8000\ninherit: true\n")
+	t.Setenv(envInheritListeners, "api:3")
+	t.Setenv(envReadyFD, "4")
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dump := cfg.Dump(); strings.Contains(dump, "api:3") || strings.Contains(dump, "fd") {
+		t.Fatalf("restart env should not be applied to config:\n%s", dump)
+	}
+	// 修改前缀后同样不作为配置覆盖
+	if err = applyEnvOverrides(&cfg.raw, "OTZRESTART_", []string{envInheritListeners + "=api:3", envReadyFD + "=4"}); err != nil {
+		t.Fatal(err)
+	}
+	if node := cfg.lookupNode("inherit"); node == nil || node.Value != "true" {
+		t.Fatalf("unexpected inherit: %v", node)
+	}
+}
+
+type testRedisConfig struct {
+	Addr    string        `yaml:"addr" default:"127.0.0.1:6379"`
+	DB      int           `yaml:"db" default:"0"`
+	Timeout time.Duration `yaml:"timeout" default:"1s"`
+	Tags    []string      `yaml:"tags" default:"a, b"`
+	Pool    struct {
+		Size int `yaml:"size" default:"8"`
+	} `yaml:"pool"`
+}
+
+func TestConfigSection(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "otz_go.yaml")
+	writeConfig(t, path, "redis:\n  addr: 10.0.0.1:6379\n  pool:\n    size: 16\n")
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetGlobalConfig(cfg)
+
+	redis, err := ConfigSection[testRedisConfig]("redis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redis.Addr != "10.0.0.1:6379" || redis.Pool.Size != 16 || redis.Timeout != time.Second ||
+		len(redis.Tags) != 2 || redis.Tags[1] != "b" {
+		t.Fatalf("unexpected section: %+v", redis)
+	}
+	if cached, _ := ConfigSection[testRedisConfig]("redis"); cached != redis {
+		t.Fatal("section should be cached")
+	}
+	missing, err := ConfigSection[testRedisConfig]("missing")
+	if err != nil || missing.Addr != "127.0.0.1:6379" {
+		t.Fatalf("missing section should use defaults: %+v, err: %v", missing, err)
+	}
+
+	// 热加载后重新解码
+	writeConfig(t, path, "redis:\n  addr: 10.0.0.2:6379\n  timeout: 3s\n")
+	if err = ReloadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	redis, err = ConfigSection[testRedisConfig]("redis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redis.Addr != "10.0.0.2:6379" || redis.Timeout != 3*time.Second || redis.Pool.Size != 8 {
+		t.Fatalf("section should be decoded again: %+v", redis)
+	}
+
+	writeConfig(t, path, "redis:\n  db: abc\n")
+	if err = ReloadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ConfigSection[testRedisConfig]("redis"); err == nil {
+		t.Fatal("invalid section should return error")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "otz_go.yaml")
+	writeConfig(t, path, `server:
+  strict_config: true
+  prot: 8080
+  port: 70000
+log:
+  - output_type: file
+    level: verbose
+  - output_type: kafka
+    format_type: json
+    max_size: -1
+redis:
+  unknown_is_ok: true
+log_fields: [request_id, tenant]
+log_webhook:
+  url: ftp://alerts
+  rate_limit: -1
+`)
+	_, err := LoadConfig(path)
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("expect ConfigErrors, got: %v", err)
+	}
+	want := []string{
+		path + ":4:9: server.port: must be between 1 and 65535, got 70000",
+		path + ":7:12: log[0].level: must be one of trace, debug, info, warn, error, fatal, got \"verbose\"",
+		path + ":6:5: log[0].file_name: is required when output_type is file",
+		path + ":8:18: log[1].output_type: must be one of console, file, got \"kafka\"",
+		path + ":10:15: log[1].max_size: must not be negative",
+		path + ":13:26: log_fields[1]: unknown field extractor \"tenant\", register it with log.RegisterFieldExtractor",
+		path + ":15:8: log_webhook.url: must be a http or https url, got \"ftp://alerts\"",
+		path + ":16:15: log_webhook.rate_limit: must not be negative",
+		path + ":3:3: server.prot: unknown field",
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("expect %d errors, got:\n%v", len(want), err)
+	}
+	for i, w := range want {
+		if errs[i].Error() != w {
+			t.Fatalf("unexpected error %d:\n%s\nwant:\n%s", i, errs[i].Error(), w)
+		}
+	}
+
+	writeConfig(t, path, "server:\n  port: abc\n")
+	_, err = LoadConfig(path)
+	if err == nil || !strings.HasPrefix(err.Error(), path+":2: ") {
+		t.Fatalf("decode error should contain position, got: %v", err)
+	}
+}
+
+func TestLayeredConfig(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.yaml")
+	writeConfig(t, base, `server:
+  port: 8080
+  trace_header: X-Base-Trace
+log:
+  - output_type: console
+    level: info
+redis:
+  addr: 10.0.0.1:6379
+  password: base_pass
+`)
+	prod := filepath.Join(dir, "prod.json")
+	writeConfig(t, prod, `{"server": {"port": 9090}, "redis": {"password": "prod_pass"}}`)
+	overlay := filepath.Join(dir, "overlay.yaml")
+	writeConfig(t, overlay, `log: !append
+  - output_type: console
+    level: error
+`)
+	cfg, err := LoadConfig(base, prod, overlay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Port != 9090 || cfg.Server.TraceHeader != "X-Base-Trace" {
+		t.Fatalf("unexpected server config: %+v", cfg.Server)
+	}
+	if n := len(cfg.lookupNode("log").Content); n != 2 {
+		t.Fatalf("log should be appended, got %d outputs", n)
+	}
+	dump := cfg.Dump()
+	if strings.Contains(dump, "prod_pass") || !strings.Contains(dump, "password: '******'") {
+		t.Fatalf("password should be masked:\n%s", dump)
+	}
+	if !strings.Contains(dump, "addr: 10.0.0.1:6379") {
+		t.Fatalf("dump should contain merged config:\n%s", dump)
+	}
+
+	// 按下标合并列表
+	writeConfig(t, overlay, "log: !merge\n  - level: debug\n")
+	cfg, err = LoadConfig(base, overlay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := cfg.lookupNode("log").Content[0]
+	if mappingValue(item, "output_type").Value != "console" || mappingValue(item, "level").Value != "debug" {
+		t.Fatalf("log[0] should be merged, got:\n%s", marshalNode(item))
+	}
+
+	// 默认替换列表, 错误定位到覆盖的文件
+	writeConfig(t, overlay, "server:\n  port: 0\nlog:\n  - level: verbose\n")
+	_, err = LoadConfig(base, overlay)
+	want := overlay + ":2:9: server.port: must be between 1 and 65535, got 0\n" +
+		overlay + ":4:12: log[0].level: must be one of trace, debug, info, warn, error, fatal, got \"verbose\""
+	if err == nil || err.Error() != want {
+		t.Fatalf("unexpected error:\n%v\nwant:\n%s", err, want)
+	}
+}
+
+func TestTOMLConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "otz_go.toml")
+	writeConfig(t, path, `
+[server]
+port = 9091
+watch_interval = "2s"
+
+[[log]]
+output_type = "console"
+level = "warn"
+`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Port != 9091 || cfg.Server.WatchInterval != 2*time.Second || cfg.Server.Ip != "0.0.0.0" {
+		t.Fatalf("unexpected server config: %+v", cfg.Server)
+	}
+	if n := len(cfg.lookupNode("log").Content); n != 1 {
+		t.Fatalf("expect 1 log output, got %d", n)
+	}
+
+	ini := filepath.Join(t.TempDir(), "otz_go.ini")
+	writeConfig(t, ini, "[server]\nport = 9091\n")
+	_, err = LoadConfig(ini)
+	if err == nil || !strings.Contains(err.Error(), "unsupported config format") {
+		t.Fatal("unsupported format should fail")
+	}
+}
+
+func TestHTTPProvider(t *testing.T) {
+	var (
+		mutex       sync.Mutex
+		content     = "server:\n  port: 8080\n"
+		version     = 1
+		notModified int32
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		etag := fmt.Sprintf(`"v%d"`, version)
+		if r.Header.Get("If-None-Match") == etag {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(content))
+	}))
+	defer srv.Close()
+
+	provider, err := NewConfigProvider(srv.URL + "/otz_go.yaml?env=test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := provider.(*HTTPProvider); !ok {
+		t.Fatalf("expect HTTPProvider, got %T", provider)
+	}
+	cfg, err := LoadConfigFrom(provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Port != 8080 {
+		t.Fatalf("expect port 8080, got %d", cfg.Server.Port)
+	}
+	SetGlobalConfig(cfg)
+
+	portChanged := make(chan int, 1)
+	defer Subscribe("server.port", func(oldCfg, newCfg *Config) {
+		portChanged <- newCfg.Server.Port
+	})()
+	stop := WatchConfig(10*time.Millisecond, provider)
+	defer stop()
+
+	// 未变化时服务端返回304, 不触发热加载
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&notModified) == 0 {
+		t.Fatal("expect conditional request with If-None-Match")
+	}
+	select {
+	case port := <-portChanged:
+		t.Fatalf("unexpected reload, port %d", port)
+	default:
+	}
+
+	mutex.Lock()
+	content, version = "server:\n  port: 9090\n", 2
+	mutex.Unlock()
+	select {
+	case port := <-portChanged:
+		if port != 9090 {
+			t.Fatalf("expect port 9090, got %d", port)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("config not reloaded")
+	}
+
+	if _, err = NewConfigProvider("etcd://127.0.0.1:2379/otz"); err == nil {
+		t.Fatal("unregistered scheme should fail")
+	}
+}
+
+type testDBConfig struct {
+	User     string `yaml:"user"`
+	Password Secret `yaml:"password"`
+	DSN      string `yaml:"dsn"`
+}
+
+func TestConfigSecret(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "db_pass")
+	writeConfig(t, secretFile, "file_pass\n")
+	t.Setenv("TEST_OTZ_DB_USER", "env_user")
+	path := filepath.Join(dir, "otz_go.yaml")
+	writeConfig(t, path, `db:
+  user: ${secret:env:TEST_OTZ_DB_USER}
+  password: ${secret:file:`+secretFile+`}
+  dsn: mysql://${secret:env:TEST_OTZ_DB_USER}@127.0.0.1/test
+`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetGlobalConfig(cfg)
+	db, err := ConfigSection[testDBConfig]("db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.User != "env_user" || db.Password.Value() != "file_pass" || db.DSN != "mysql://env_user@127.0.0.1/test" {
+		t.Fatalf("unexpected db config: %+v", *db)
+	}
+	if s := fmt.Sprintf("%v %+v", db.Password, *db); strings.Contains(s, "file_pass") {
+		t.Fatalf("secret should be masked when printed: %s", s)
+	}
+	dump := cfg.Dump()
+	if strings.Contains(dump, "file_pass") || strings.Contains(dump, "env_user") {
+		t.Fatalf("secrets should be masked in dump:\n%s", dump)
+	}
+
+	// 密钥轮换后热加载
+	passChanged := make(chan string, 1)
+	defer Subscribe("db.password", func(oldCfg, newCfg *Config) {
+		passChanged <- newCfg.lookupNode("db.password").Value
+	})()
+	stop := WatchConfig(10*time.Millisecond, NewFileProvider(path))
+	defer stop()
+	writeConfig(t, secretFile, "rotated_pass\n")
+	select {
+	case pass := <-passChanged:
+		if pass != "rotated_pass" {
+			t.Fatalf("expect rotated_pass, got %s", pass)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("secret rotation not reloaded")
+	}
+
+	writeConfig(t, path, "db:\n  password: ${secret:nosuch:db/pass}\n")
+	_, err = LoadConfig(path)
+	want := path + ":2:13: db.password: unknown secret resolver nosuch"
+	if err == nil || err.Error() != want {
+		t.Fatalf("unexpected error: %v, want: %s", err, want)
+	}
+	writeConfig(t, path, "db:\n  password: ${secret:vault:db/pass}\n")
+	RegisterSecretResolver("vault", SecretResolverFunc(func(ref string) (string, error) {
+		return "vault_" + ref, nil
+	}))
+	cfg, err = LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := cfg.lookupNode("db.password").Value; v != "vault_db/pass" {
+		t.Fatalf("unexpected vault secret %s", v)
+	}
+}
+
+func TestConfigSecretDecodeError(t *testing.T) {
+	// 密钥解析到非字符串字段时, 解码错误中不包含密钥
+	t.Setenv("TEST_OTZ_REDIS_DB", "s3cr3t-db-value")
+	cfg, err := ParseConfig("otz_go.yaml", []byte("redis:\n  db: ${secret:env:TEST_OTZ_REDIS_DB}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = decodeSection[testRedisConfig](cfg, "redis")
+	if err == nil || strings.Contains(err.Error(), "s3cr3t") || !strings.Contains(err.Error(), maskedValue) {
+		t.Fatalf("secret should be redacted in decode error: %v", err)
+	}
+
+	t.Setenv("TEST_OTZ_PORT", "p4ss")
+	t.Setenv("OTZ_SERVER_PORT", "${secret:env:TEST_OTZ_PORT}")
+	_, err = ParseConfig("otz_go.yaml", []byte("server:\n  ip: 127.0.0.1\n"))
+	if err == nil || strings.Contains(err.Error(), "p4ss") || !strings.Contains(err.Error(), maskedValue) {
+		t.Fatalf("secret should be redacted in decode error: %v", err)
+	}
+}
+
+func TestConfigSecretTypes(t *testing.T) {
+	// 密钥可以用于数字及时长等非字符串配置
+	t.Setenv("TEST_OTZ_PORT", "9000")
+	t.Setenv("TEST_OTZ_INTERVAL", "3s")
+	t.Setenv("TEST_OTZ_REDIS_DB", "0")
+	cfg, err := ParseConfig("otz_go.yaml", []byte(`server:
+  port: ${secret:env:TEST_OTZ_PORT}
+  watch_interval: ${secret:env:TEST_OTZ_INTERVAL}
+redis:
+  db: ${secret:env:TEST_OTZ_REDIS_DB}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Port != 9000 || cfg.Server.WatchInterval != 3*time.Second {
+		t.Fatalf("unexpected port %d, watch interval %s", cfg.Server.Port, cfg.Server.WatchInterval)
+	}
+	redis, err := decodeSection[testRedisConfig](cfg, "redis")
+	if err != nil || redis.DB != 0 {
+		t.Fatalf("unexpected redis config: %+v, err: %v", redis, err)
+	}
+
+	// 只脱敏引用了密钥的配置, 较短的密钥不影响其他错误信息
+	_, err = ParseConfig("otz_go.yaml", []byte(`server:
+  port: 70000
+  health:
+    shutdown_delay: -10s
+redis:
+  db: ${secret:env:TEST_OTZ_REDIS_DB}
+`))
+	want := "otz_go.yaml:2:9: server.port: must be between 1 and 65535, got 70000\n" +
+		"otz_go.yaml:4:21: server.health.shutdown_delay: must not be negative"
+	if err == nil || err.Error() != want {
+		t.Fatalf("unexpected error:\n%v\nwant:\n%s", err, want)
+	}
+	t.Setenv("TEST_OTZ_PORT", "70000")
+	_, err = ParseConfig("otz_go.yaml", []byte("server:\n  port: ${secret:env:TEST_OTZ_PORT}\n"))
+	want = "otz_go.yaml:2:9: server.port: must be between 1 and 65535, got " + maskedValue
+	if err == nil || err.Error() != want {
+		t.Fatalf("unexpected error: %v, want: %s", err, want)
+	}
+}
+
+func TestServerReloadConfig(t *testing.T) {
+	dir := t.TempDir()
+	pathA := filepath.Join(dir, "a.yaml")
+	pathB := filepath.Join(dir, "b.yaml")
+	pathGlobal := filepath.Join(dir, "global.yaml")
+	writeConfig(t, pathA, "server:\n  trace_header: X-A\n")
+	writeConfig(t, pathB, "server:\n  trace_header: X-B\n")
+	writeConfig(t, pathGlobal, "server:\n  trace_header: X-Global\n")
+	a, err := New(WithConfigFile(pathA), WithLogger(logtest.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(WithConfigFile(pathB), WithLogger(logtest.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 全局配置热加载不影响非全局服务
+	if err = ReloadConfig(pathGlobal); err != nil {
+		t.Fatal(err)
+	}
+	if GetGlobalConfig().Server.TraceHeader != "X-Global" {
+		t.Fatalf("unexpected global trace header: %s", GetGlobalConfig().Server.TraceHeader)
+	}
+	if a.currentConfig().Server.TraceHeader != "X-A" || b.currentConfig().Server.TraceHeader != "X-B" {
+		t.Fatalf("global reload should not replace server config, a: %s, b: %s",
+			a.currentConfig().Server.TraceHeader, b.currentConfig().Server.TraceHeader)
+	}
+
+	// 服务热加载只替换自己的配置
+	writeConfig(t, pathA, "server:\n  trace_header: X-A2\n")
+	if err = a.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if a.currentConfig().Server.TraceHeader != "X-A2" || b.currentConfig().Server.TraceHeader != "X-B" ||
+		GetGlobalConfig().Server.TraceHeader != "X-Global" {
+		t.Fatalf("unexpected trace header after server reload, a: %s, b: %s, global: %s",
+			a.currentConfig().Server.TraceHeader, b.currentConfig().Server.TraceHeader,
+			GetGlobalConfig().Server.TraceHeader)
+	}
+	// 非法配置不生效
+	writeConfig(t, pathA, "server:\n  port: [\n")
+	if err = a.ReloadConfig(); err == nil {
+		t.Fatal("invalid config should be rejected")
+	}
+	if a.currentConfig().Server.TraceHeader != "X-A2" {
+		t.Fatalf("invalid config should not replace server config: %s", a.currentConfig().Server.TraceHeader)
+	}
+}
@@ -0,0 +1,373 @@
+package otz
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ShadowsGtt/otz/log"
+	"gopkg.in/yaml.v3"
+	"net"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ConfigError 配置错误, 包含配置文件中的位置
+type ConfigError struct {
+	File   string // 配置文件, 来自环境变量或命令行覆盖时为override
+	Line   int    // 行号, 为0表示无法定位(如toml文件)
+	Column int    // 列号
+	Path   string // 配置路径, 如 server.port
+	Msg    string
+}
+
+// Error 错误信息, 格式 file:line:column: path: msg
+func (e *ConfigError) Error() string {
+	pos := e.File
+	if e.Line > 0 && e.Column > 0 {
+		pos = fmt.Sprintf("%s:%d:%d", e.File, e.Line, e.Column)
+	} else if e.Line > 0 {
+		pos = fmt.Sprintf("%s:%d", e.File, e.Line)
+	}
+	if e.Path == "" {
+		return fmt.Sprintf("%s: %s", pos, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s: %s", pos, e.Path, e.Msg)
+}
+
+// ConfigErrors 配置错误列表
+type ConfigErrors []*ConfigError
+
+// Error 每行一个错误
+func (es ConfigErrors) Error() string {
+	msgs := make([]string, 0, len(es))
+	for _, e := range es {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+var yamlErrLinePattern = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// wrapDecodeError 将yaml解码错误转换为带文件位置的ConfigErrors, secretNodes中节点的值在错误信息中脱敏
+func wrapDecodeError(file string, err error, secretNodes map[*yaml.Node]bool) error {
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return &ConfigError{File: file, Msg: redactSecrets(strings.TrimPrefix(err.Error(), "yaml: "), secretNodes)}
+	}
+	errs := ConfigErrors{}
+	for _, msg := range typeErr.Errors {
+		msg = redactSecrets(msg, secretNodes)
+		e := &ConfigError{File: file, Msg: msg}
+		if m := yamlErrLinePattern.FindStringSubmatch(msg); m != nil {
+			e.Line, _ = strconv.Atoi(m[1])
+			e.Msg = m[2]
+		}
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+var (
+	logOutputTypes = map[log.OutputType]bool{"": true, log.OutputTypeConsole: true, log.OutputTypeFile: true}
+	logFormatTypes = map[log.FormatType]bool{"": true, log.FormatTypeText: true, log.FormatTypeJSON: true}
+)
+
+type configValidator struct {
+	file        string
+	nodeFiles   map[*yaml.Node]string
+	secretNodes map[*yaml.Node]bool
+	errs        ConfigErrors
+}
+
+func (v *configValidator) add(node *yaml.Node, path string, format string, args ...interface{}) {
+	e := &ConfigError{File: v.file, Path: path, Msg: fmt.Sprintf(format, redactSecretArgs(node, v.secretNodes, args)...)}
+	if node != nil {
+		file, ok := v.nodeFiles[node]
+		if !ok {
+			// 不属于任何配置文件, 来自环境变量或命令行覆盖
+			file = "override"
+		}
+		e.File, e.Line, e.Column = file, node.Line, node.Column
+		if !ok {
+			e.Line, e.Column = 0, 0
+		}
+	}
+	v.errs = append(v.errs, e)
+}
+
+// Validate 校验配置, 返回ConfigErrors, 包含所有错误及其在配置文件中的位置
+func (c *Config) Validate() error {
+	v := &configValidator{file: c.file, nodeFiles: c.nodeFiles, secretNodes: c.secretNodes}
+	if c.file == "" {
+		v.file = "config"
+	}
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		v.add(c.lookupNode("server.port"), "server.port", "must be between 1 and 65535, got %d", c.Server.Port)
+	}
+	if c.Server.WatchInterval < 0 {
+		v.add(c.lookupNode("server.watch_interval"), "server.watch_interval", "must not be negative")
+	}
+	if c.Server.Timeout.Default < 0 {
+		v.add(c.lookupNode("server.timeout.default"), "server.timeout.default", "must not be negative")
+	}
+	for route, timeout := range c.Server.Timeout.Routes {
+		if timeout < 0 {
+			v.add(c.lookupNode("server.timeout.routes"), "server.timeout.routes", "timeout of %s must not be negative", route)
+		}
+	}
+	if c.Server.Health.CacheInterval < 0 {
+		v.add(c.lookupNode("server.health.cache_interval"), "server.health.cache_interval", "must not be negative")
+	}
+	if c.Server.Health.ShutdownDelay < 0 {
+		v.add(c.lookupNode("server.health.shutdown_delay"), "server.health.shutdown_delay", "must not be negative")
+	}
+	if admin := c.Server.Admin; admin.Enabled() {
+		if _, _, err := net.SplitHostPort(admin.Address); err != nil {
+			v.add(c.lookupNode("server.admin.address"), "server.admin.address", "must be ip:port, got %q", admin.Address)
+		}
+		if _, err := parseAllowIPs(admin.AllowIPs); err != nil {
+			v.add(c.lookupNode("server.admin.allow_ips"), "server.admin.allow_ips", "%v", err)
+		}
+	}
+	v.validateTLS(c.lookupNode("server.tls"), "server.tls", c.Server.TLS)
+	v.validateTransport(c.lookupNode("server.transport"), "server.transport", c.Server.Transport, c.Server.TLS)
+	v.validateServices(c.lookupNode("server.services"), c.Server.Services)
+	v.validateLog(c.lookupNode("log"))
+	v.validateLogFields(c.lookupNode("log_fields"), c.LogFields)
+	v.validateLogWebhook(c.lookupNode("log_webhook"), c.LogWebhook)
+	if tracing := c.Tracing; tracing.Enabled() && tracing.Exporter != TracingExporterOTLP {
+		v.add(c.lookupNode("tracing.exporter"), "tracing.exporter", "must be %s, got %q", TracingExporterOTLP, tracing.Exporter)
+	}
+	if ratio := c.Tracing.SampleRatio; ratio < 0 || ratio > 1 {
+		v.add(c.lookupNode("tracing.sample_ratio"), "tracing.sample_ratio", "must be between 0 and 1, got %v", ratio)
+	}
+	if c.Server.StrictConfig {
+		v.checkKnownFields(rootMapping(&c.raw))
+	}
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+	return nil
+}
+
+func (v *configValidator) validateServices(node *yaml.Node, services []ServiceConfig) {
+	names := map[string]bool{}
+	for i, svc := range services {
+		path := fmt.Sprintf("server.services[%d]", i)
+		var item *yaml.Node
+		if node != nil && node.Kind == yaml.SequenceNode && i < len(node.Content) {
+			item = node.Content[i]
+		}
+		field := func(key string) (*yaml.Node, string) {
+			if n := mappingValue(item, key); n != nil {
+				return n, path + "." + key
+			}
+			return item, path + "." + key
+		}
+		if svc.Name == "" {
+			n, p := field("name")
+			v.add(n, p, "is required")
+		} else if names[svc.Name] {
+			n, p := field("name")
+			v.add(n, p, "duplicate service %q", svc.Name)
+		} else if svc.Name == adminServiceName {
+			n, p := field("name")
+			v.add(n, p, "%q is reserved for server.admin", svc.Name)
+		}
+		names[svc.Name] = true
+		switch svc.Type {
+		case "", ServiceTypeHTTP, ServiceTypeGRPC:
+		case ServiceTypeMux:
+			// 明文http/1.1无法承载grpc
+			if !svc.TLS.Enabled() && svc.Transport.Protocol != ProtocolH2C {
+				n, p := field("type")
+				v.add(n, p, "mux requires tls or transport.protocol h2c")
+			} else if svc.Transport.Protocol == ProtocolHTTP1 {
+				n, p := field("type")
+				v.add(n, p, "mux requires http/2, transport.protocol must not be http1")
+			}
+		default:
+			n, p := field("type")
+			v.add(n, p, "must be one of http, grpc, mux, got %q", svc.Type)
+		}
+		switch svc.Network {
+		case "", NetworkTCP:
+			if _, _, err := net.SplitHostPort(svc.Address); err != nil {
+				n, p := field("address")
+				v.add(n, p, "must be ip:port, got %q", svc.Address)
+			}
+		case NetworkUnix:
+			if svc.Address == "" {
+				n, p := field("address")
+				v.add(n, p, "is required")
+			}
+		default:
+			n, p := field("network")
+			v.add(n, p, "must be one of tcp, unix, got %q", svc.Network)
+		}
+		v.validateTLS(mappingValue(item, "tls"), path+".tls", svc.TLS)
+		v.validateTransport(mappingValue(item, "transport"), path+".transport", svc.Transport, svc.TLS)
+	}
+}
+
+func (v *configValidator) validateTransport(node *yaml.Node, path string, c TransportConfig, tlsCfg TLSConfig) {
+	if err := c.validate(); err != nil {
+		v.add(node, path, "%v", err)
+	} else if c.Protocol == ProtocolH2C && tlsCfg.Enabled() {
+		v.add(node, path, "h2c can not be used with tls, http/2 is negotiated by alpn")
+	}
+}
+
+func (v *configValidator) validateTLS(node *yaml.Node, path string, c TLSConfig) {
+	if !c.Enabled() {
+		return
+	}
+	if _, err := c.baseTLSConfig(); err != nil {
+		v.add(node, path, "%v", err)
+	}
+}
+
+func (v *configValidator) validateLog(node *yaml.Node) {
+	if node == nil || node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		return
+	}
+	if node.Kind != yaml.SequenceNode {
+		v.add(node, "log", "must be a list of outputs")
+		return
+	}
+	for i, item := range node.Content {
+		path := fmt.Sprintf("log[%d]", i)
+		c := log.Config{}
+		if err := item.Decode(&c); err != nil {
+			v.add(item, path, "%s", strings.TrimPrefix(err.Error(), "yaml: "))
+			continue
+		}
+		field := func(key string) (*yaml.Node, string) {
+			return mappingValue(item, key), path + "." + key
+		}
+		if !logOutputTypes[c.OutputType] {
+			n, p := field("output_type")
+			v.add(n, p, "must be one of console, file, got %q", c.OutputType)
+		}
+		if !logFormatTypes[c.FormatType] {
+			n, p := field("format_type")
+			v.add(n, p, "must be one of text, json, got %q", c.FormatType)
+		}
+		if _, ok := log.Levels[c.Level]; !ok {
+			n, p := field("level")
+			v.add(n, p, "must be one of trace, debug, info, warn, error, fatal, got %q", c.Level)
+		}
+		if c.OutputType == log.OutputTypeFile && c.FileName == "" {
+			v.add(item, path+".file_name", "is required when output_type is file")
+		}
+		for _, f := range []struct {
+			key   string
+			value int
+		}{{"max_size", c.MaxSize}, {"max_age", c.MaxAge}, {"max_backups", c.MaxBackups}} {
+			if f.value < 0 {
+				n, p := field(f.key)
+				v.add(n, p, "must not be negative")
+			}
+		}
+	}
+}
+
+// validateLogFields 日志字段需使用内置或已注册的提取器
+func (v *configValidator) validateLogFields(node *yaml.Node, fields []string) {
+	for i, name := range fields {
+		if log.FieldExtractorRegistered(name) {
+			continue
+		}
+		item := node
+		if node != nil && node.Kind == yaml.SequenceNode && i < len(node.Content) {
+			item = node.Content[i]
+		}
+		v.add(item, fmt.Sprintf("log_fields[%d]", i), "unknown field extractor %q, register it with log.RegisterFieldExtractor", name)
+	}
+}
+
+func (v *configValidator) validateLogWebhook(node *yaml.Node, c log.WebhookConfig) {
+	field := func(key string) (*yaml.Node, string) {
+		if n := mappingValue(node, key); n != nil {
+			return n, "log_webhook." + key
+		}
+		return node, "log_webhook." + key
+	}
+	if c.URL != "" {
+		if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			n, p := field("url")
+			v.add(n, p, "must be a http or https url, got %q", c.URL)
+		}
+	}
+	if c.Level != "" {
+		if _, ok := log.ParseLevel(c.Level); !ok {
+			n, p := field("level")
+			v.add(n, p, "unknown level %q", c.Level)
+		}
+	}
+	for _, f := range []struct {
+		key   string
+		value int64
+	}{
+		{"interval", int64(c.Interval)}, {"timeout", int64(c.Timeout)}, {"max_alerts", int64(c.MaxAlerts)},
+		{"dedup_window", int64(c.DedupWindow)}, {"rate_limit", int64(c.RateLimit)},
+	} {
+		if f.value < 0 {
+			n, p := field(f.key)
+			v.add(n, p, "must not be negative")
+		}
+	}
+}
+
+// knownSections 框架使用的顶层配置及其类型, 其余顶层配置为业务自定义配置
+func knownSections() map[string]reflect.Type {
+	sections := knownKeys(nil, reflect.TypeOf(Config{}))
+	sections["log"] = reflect.TypeOf([]log.Config{})
+	return sections
+}
+
+// checkKnownFields 严格模式下检查框架配置中未知的key
+func (v *configValidator) checkKnownFields(root *yaml.Node) {
+	if root == nil || root.Kind != yaml.MappingNode {
+		return
+	}
+	sections := knownSections()
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key := root.Content[i].Value
+		if typ, ok := sections[key]; ok {
+			v.checkNode(root.Content[i+1], typ, key)
+		}
+	}
+}
+
+var yamlNodeType = reflect.TypeOf(yaml.Node{})
+
+func (v *configValidator) checkNode(node *yaml.Node, typ reflect.Type, path string) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	switch {
+	case typ == yamlNodeType:
+	case typ.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		fields := knownKeys(nil, typ)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			fieldTyp, ok := fields[key.Value]
+			if !ok {
+				v.add(key, path+"."+key.Value, "unknown field")
+				continue
+			}
+			v.checkNode(node.Content[i+1], fieldTyp, path+"."+key.Value)
+		}
+	case typ.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		for i, item := range node.Content {
+			v.checkNode(item, typ.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case typ.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			v.checkNode(node.Content[i+1], typ.Elem(), path+"."+node.Content[i].Value)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package otz
+
+import (
+	"bytes"
+	"github.com/ShadowsGtt/otz/log"
+	"gopkg.in/yaml.v3"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWatchInterval = 5 * time.Second
+)
+
+// ConfigSubscriber 配置变化回调
+type ConfigSubscriber func(oldCfg, newCfg *Config)
+
+type subscriber struct {
+	id      int
+	keyPath string
+	fn      ConfigSubscriber
+}
+
+var (
+	subscribers     []*subscriber
+	subscriberID    int
+	subscriberMutex sync.Mutex
+	reloadMutex     sync.Mutex
+)
+
+// Subscribe 订阅配置变化, keyPath为配置路径如 server.port, 为空时任意变化都会回调
+// 只在keyPath对应的配置发生变化时回调, 返回取消订阅函数
+func Subscribe(keyPath string, fn ConfigSubscriber) (unsubscribe func()) {
+	subscriberMutex.Lock()
+	defer subscriberMutex.Unlock()
+	subscriberID++
+	id := subscriberID
+	subscribers = append(subscribers, &subscriber{id: id, keyPath: keyPath, fn: fn})
+	return func() {
+		subscriberMutex.Lock()
+		defer subscriberMutex.Unlock()
+		for i, s := range subscribers {
+			if s.id == id {
+				subscribers = append(subscribers[:i:i], subscribers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// ReloadConfig 重新加载配置文件, 加载及校验通过后替换全局配置并通知订阅者
+// 校验失败时保留原配置并返回错误
+func ReloadConfig(uris ...string) error {
+	providers, err := newConfigProviders(uris)
+	if err != nil {
+		return err
+	}
+	return ReloadConfigFrom(providers...)
+}
+
+// ReloadConfigFrom 从指定的配置来源重新加载配置, 同ReloadConfig
+func ReloadConfigFrom(providers ...ConfigProvider) error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	newCfg, err := LoadConfigFrom(providers...)
+	if err != nil {
+		return err
+	}
+	oldCfg, _ := globalServerConfig.Load().(*Config)
+	SetGlobalConfig(newCfg)
+	notifySubscribers(oldCfg, newCfg)
+	return nil
+}
+
+func notifySubscribers(oldCfg, newCfg *Config) {
+	subscriberMutex.Lock()
+	subs := make([]*subscriber, len(subscribers))
+	copy(subs, subscribers)
+	subscriberMutex.Unlock()
+
+	for _, s := range subs {
+		if !configChanged(oldCfg, newCfg, s.keyPath) {
+			continue
+		}
+		notify(s, oldCfg, newCfg)
+	}
+}
+
+func notify(s *subscriber, oldCfg, newCfg *Config) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Errorf("config subscriber %s panic: %v, stack: %s", s.keyPath, err, string(debug.Stack()))
+		}
+	}()
+	s.fn(oldCfg, newCfg)
+}
+
+// configChanged keyPath对应的配置是否变化
+func configChanged(oldCfg, newCfg *Config, keyPath string) bool {
+	if oldCfg == nil {
+		return true
+	}
+	return !bytes.Equal(marshalNode(oldCfg.lookupNode(keyPath)), marshalNode(newCfg.lookupNode(keyPath)))
+}
+
+func marshalNode(node *yaml.Node) []byte {
+	if node == nil {
+		return nil
+	}
+	out, err := yaml.Marshal(node)
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// WatchConfig 定时检查配置来源, 任一配置变化或引用的密钥轮换后热加载所有配置并替换全局配置, 返回停止监听函数
+func WatchConfig(interval time.Duration, providers ...ConfigProvider) (stop func()) {
+	return watchConfig(interval, providers, log.Infof, log.Errorf, func() error {
+		return ReloadConfigFrom(providers...)
+	}, func() *Config {
+		cfg, _ := globalServerConfig.Load().(*Config)
+		return cfg
+	})
+}
+
+// watchConfig 配置来源变化或current引用的密钥轮换后调用reload, 结果通过infof及errorf输出
+func watchConfig(interval time.Duration, providers []ConfigProvider, infof, errorf func(format string, args ...interface{}),
+	reload func() error, current func() *Config) (stop func()) {
+	names := make([]string, 0, len(providers))
+	for _, p := range providers {
+		names = append(names, p.Name())
+	}
+	onChange := func() {
+		if err := reload(); err != nil {
+			errorf("reload config %v failed, keep current config, err: %v", names, err)
+			return
+		}
+		infof("reload config %v success", names)
+	}
+	stops := make([]func(), 0, len(providers)+1)
+	for _, p := range providers {
+		stops = append(stops, p.Watch(interval, onChange))
+	}
+	stops = append(stops, pollConfig(interval, func() bool {
+		cfg := current()
+		return cfg != nil && cfg.secretsChanged()
+	}, onChange))
+	return func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
+}
@@ -34,6 +34,10 @@ func Newf(code int, format string, params ...interface{}) error {
 
 const (
 	CodeSuccess = 0
+	// CodeCanceled 客户端取消请求
+	CodeCanceled = 499
+	// CodeTimeout 请求处理超时
+	CodeTimeout = 504
 	CodeUnknown = 999
 )
 
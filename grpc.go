@@ -0,0 +1,274 @@
+package otz
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/ShadowsGtt/otz/errs"
+	"github.com/ShadowsGtt/otz/log"
+	"github.com/ShadowsGtt/otz/otzctx"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ServiceTypeHTTP = "http" // 只提供http接口
+	ServiceTypeGRPC = "grpc" // 只提供grpc接口
+	// ServiceTypeMux 同一端口同时提供http及grpc接口, 按content-type区分, 需要开启tls或h2c
+	ServiceTypeMux = "mux"
+
+	// grpcErrorDomain errs.Error转换为grpc status时ErrorInfo的domain
+	grpcErrorDomain = "otz"
+)
+
+// GRPCCodes errs.Error错误码到grpc状态码的映射, 未列出的错误码为codes.Unknown
+// 错误码及错误信息通过status details中的ErrorInfo传递, 客户端可以使用ErrorFromGRPC还原
+var GRPCCodes = map[int]codes.Code{
+	400: codes.InvalidArgument,
+	401: codes.Unauthenticated,
+	403: codes.PermissionDenied,
+	404: codes.NotFound,
+	409: codes.AlreadyExists,
+	429: codes.ResourceExhausted,
+	499: codes.Canceled,
+	500: codes.Internal,
+	501: codes.Unimplemented,
+	503: codes.Unavailable,
+	504: codes.DeadlineExceeded,
+}
+
+// GRPCError 将错误转换为grpc status错误, errs.Error按GRPCCodes映射并携带错误码
+func GRPCError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	var e *errs.Error
+	if !errors.As(err, &e) {
+		return status.Error(codes.Unknown, err.Error())
+	}
+	code, ok := GRPCCodes[e.Code]
+	if !ok {
+		code = codes.Unknown
+	}
+	st, detailErr := status.New(code, e.Msg).WithDetails(&errdetails.ErrorInfo{
+		Reason:   strconv.Itoa(e.Code),
+		Domain:   grpcErrorDomain,
+		Metadata: map[string]string{"code": strconv.Itoa(e.Code)},
+	})
+	if detailErr != nil {
+		return status.Error(code, e.Msg)
+	}
+	return st.Err()
+}
+
+// ErrorFromGRPC 将grpc客户端收到的错误还原为errs.Error, 非otz服务返回的错误原样返回
+func ErrorFromGRPC(err error) error {
+	st, ok := status.FromError(err)
+	if !ok || err == nil {
+		return err
+	}
+	for _, d := range st.Details() {
+		info, ok := d.(*errdetails.ErrorInfo)
+		if !ok || info.Domain != grpcErrorDomain {
+			continue
+		}
+		if code, convErr := strconv.Atoi(info.Metadata["code"]); convErr == nil {
+			return errs.New(code, st.Message())
+		}
+	}
+	return err
+}
+
+// grpcRegistration 启动前注册的grpc服务, 启动时注册到grpc.Server
+type grpcRegistration struct {
+	desc *grpc.ServiceDesc
+	impl interface{}
+}
+
+// RegisterService 注册grpc服务, 实现grpc.ServiceRegistrar, 可以直接传给生成的 pb.RegisterXxxServer
+func (svc *Service) RegisterService(desc *grpc.ServiceDesc, impl interface{}) {
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+	if svc.err == nil && svc.cfg.Type != ServiceTypeGRPC && svc.cfg.Type != ServiceTypeMux {
+		svc.err = fmt.Errorf("service %s is not a grpc service, type: %s", svc.cfg.Name, svc.cfg.serviceType())
+	}
+	svc.grpcServices = append(svc.grpcServices, grpcRegistration{desc: desc, impl: impl})
+}
+
+// RegisterService 在第一个grpc或mux类型的服务上注册grpc服务
+func (s *Server) RegisterService(desc *grpc.ServiceDesc, impl interface{}) {
+	for _, svc := range s.services {
+		if svc.cfg.Type == ServiceTypeGRPC || svc.cfg.Type == ServiceTypeMux {
+			svc.RegisterService(desc, impl)
+			return
+		}
+	}
+	svc := s.Service("grpc")
+	svc.mutex.Lock()
+	svc.err = errors.New("no grpc service configured, set type: grpc or mux in server.services")
+	svc.mutex.Unlock()
+	svc.RegisterService(desc, impl)
+}
+
+// newGRPCServer 创建grpc.Server并注册服务, creds不为空时使用tls
+func (svc *Service) newGRPCServer(creds credentials.TransportCredentials) *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(svc.unaryInterceptor),
+		grpc.ChainStreamInterceptor(svc.streamInterceptor),
+	}
+	if creds != nil {
+		opts = append(opts, grpc.Creds(creds))
+	}
+	if t := svc.cfg.Transport; t.IdleTimeout > 0 {
+		opts = append(opts, grpc.KeepaliveParams(keepalive.ServerParameters{MaxConnectionIdle: t.IdleTimeout}))
+	}
+	srv := grpc.NewServer(opts...)
+	for _, r := range svc.grpcServices {
+		srv.RegisterService(r.desc, r.impl)
+	}
+	return srv
+}
+
+// isGRPCRequest 是否为grpc请求, 用于mux类型服务分发
+func isGRPCRequest(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// muxHandler 同一端口分发http及grpc请求, calls跟踪处理中的grpc请求, 停止时等待其结束
+func muxHandler(grpcServer *grpc.Server, httpHandler http.Handler, calls *activeTracker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isGRPCRequest(r) {
+			calls.add(nil)
+			defer calls.done(nil)
+			grpcServer.ServeHTTP(w, r)
+			return
+		}
+		httpHandler.ServeHTTP(w, r)
+	})
+}
+
+// newGRPCContext 创建grpc请求的otz ctx, 设置请求信息, 客户端身份及请求级logger
+func (svc *Service) newGRPCContext(ctx context.Context, method string) otzctx.Context {
+	otzCtx := otzctx.GetOrNewOTZContext(ctx)
+	md, _ := metadata.FromIncomingContext(ctx)
+	req := &otzctx.Request{
+		Protocol: "grpc",
+		Route:    method,
+		Header: func(key string) string {
+			if values := md.Get(key); len(values) > 0 {
+				return values[0]
+			}
+			return ""
+		},
+	}
+	requestID := req.GetHeader(log.RequestIDHeader)
+	if requestID == "" {
+		b := make([]byte, 16)
+		_, _ = rand.Read(b)
+		requestID = hex.EncodeToString(b)
+		md = md.Copy()
+		md.Set(log.RequestIDHeader, requestID)
+	}
+	_ = grpc.SetHeader(ctx, metadata.Pairs(log.RequestIDHeader, requestID))
+	if p, ok := peer.FromContext(ctx); ok {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			req.ClientIP = host
+		}
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+			otzCtx.SetPeer(otzctx.NewPeer(info.State.VerifiedChains[0][0]))
+		}
+	}
+	otzCtx.SetRequest(req)
+	log.WithLoggerCtx(otzCtx.Context(), svc.server.getLogger())
+	if svc.server.traceEnabled(req.GetHeader) {
+		log.WithLevelCtx(otzCtx.Context(), log.LevelTrace)
+	}
+	return otzCtx
+}
+
+// handleGRPC 执行拦截器及业务处理, 记录访问日志, 将错误转换为grpc status
+func (svc *Service) handleGRPC(ctx context.Context, method string, handler func(ctx context.Context) error) (err error) {
+	otzCtx := svc.newGRPCContext(ctx, method)
+	defer otzctx.PutOTZCtx(otzCtx)
+	begin := time.Now()
+	var metrics *requestMetrics
+	if svc.metricsEnabled() {
+		metrics = beginRequest(svc.cfg.Name, "grpc", "GRPC")
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			log.ErrorCtxf(otzCtx.Context(), "%v\n%s", e, string(debug.Stack()))
+			err = status.Error(codes.Internal, "internal error")
+		}
+		if metrics != nil {
+			metrics.end(method, status.Code(err).String(), errs.Code(ErrorFromGRPC(err)))
+		}
+		log.InfoCtxf(otzCtx.Context(), "URI: %s, code: %s, cost: %dms",
+			method, status.Code(err), time.Since(begin).Milliseconds(),
+		)
+	}()
+	called := false
+	svc.chain(func(ctx context.Context) {
+		called = true
+		err = svc.callGRPCHandler(ctx, handler)
+		if err != nil {
+			// 供拦截器获取处理结果
+			otzCtx.SetError(err)
+		}
+	})(otzCtx.Context())
+	if !called {
+		// 拦截器中断请求, 错误由abortRequest设置
+		err = otzCtx.GetError()
+	}
+	return GRPCError(err)
+}
+
+func (svc *Service) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (resp interface{}, err error) {
+	err = svc.handleGRPC(ctx, info.FullMethod, func(ctx context.Context) error {
+		var handleErr error
+		resp, handleErr = handler(ctx, req)
+		return handleErr
+	})
+	return resp, err
+}
+
+// serverStream 替换stream的ctx为otz ctx
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func (svc *Service) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+	return svc.handleGRPC(ss.Context(), info.FullMethod, func(ctx context.Context) error {
+		return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	})
+}
@@ -0,0 +1,283 @@
+package otz
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/ShadowsGtt/otz/errs"
+	"github.com/ShadowsGtt/otz/log"
+	"github.com/ShadowsGtt/otz/log/logtest"
+	"github.com/ShadowsGtt/otz/otzctx"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testHealthServer struct {
+	grpc_health_v1.UnimplementedHealthServer
+}
+
+func (h *testHealthServer) Check(ctx context.Context,
+	req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	r := otzctx.OTZContext(ctx).GetRequest()
+	if r == nil || r.Route != "/grpc.health.v1.Health/Check" || r.ClientIP != "127.0.0.1" {
+		return nil, errors.New("request not set in otz ctx")
+	}
+	if req.Service != "" {
+		return nil, errs.Newf(404, "service %s not found", req.Service)
+	}
+	return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil
+}
+
+func TestGRPC(t *testing.T) {
+	RegisterInterceptor("test_grpc_auth", func(ctx context.Context, next HandlerFunc) {
+		otzCtx := otzctx.OTZContext(ctx)
+		if otzCtx.GetRequest().GetHeader("x-token") != "secret" {
+			otzCtx.SetError(errs.New(401, "invalid token"))
+			return
+		}
+		next(ctx)
+	})
+	cfg, err := ParseConfig("otz_go.yaml", []byte(`server:
+  services:
+    - name: rpc
+      type: grpc
+      address: 127.0.0.1:0
+      interceptors: [test_grpc_auth]
+    - name: web
+      type: mux
+      address: 127.0.0.1:0
+      transport:
+        protocol: h2c
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpcLn, _ := net.Listen("tcp", "127.0.0.1:0")
+	webLn, _ := net.Listen("tcp", "127.0.0.1:0")
+	s, err := New(WithConfig(cfg), WithLogger(logtest.New()),
+		WithServiceListener("rpc", rpcLn), WithServiceListener("web", webLn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpc_health_v1.RegisterHealthServer(s.Service("rpc"), &testHealthServer{})
+	grpc_health_v1.RegisterHealthServer(s.Service("web"), &testHealthServer{})
+	s.Service("web").Register("/hello", func(ctx context.Context) {
+		otzctx.OTZContext(ctx).GetGinCtx().String(http.StatusOK, "hello")
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Start()
+	}()
+
+	for _, ln := range []net.Listener{rpcLn, webLn} {
+		conn, err := grpc.Dial(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		client := grpc_health_v1.NewHealthClient(conn)
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-token", "secret")
+
+		var header metadata.MD
+		rsp, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{}, grpc.Header(&header), grpc.WaitForReady(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rsp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+			t.Fatalf("unexpected status %s", rsp.Status)
+		}
+		if len(header.Get(log.RequestIDHeader)) == 0 {
+			t.Fatal("request id should be set in response header")
+		}
+
+		// errs.Error映射为grpc状态码, 客户端可以还原错误码
+		_, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: "missing"})
+		if status.Code(err) != codes.NotFound {
+			t.Fatalf("expect NotFound, got %v", err)
+		}
+		if e := ErrorFromGRPC(err); errs.Code(e) != 404 || errs.Msg(e) != "service missing not found" {
+			t.Fatalf("unexpected error: %v", e)
+		}
+	}
+
+	// 拦截器中断请求
+	conn, _ := grpc.Dial(rpcLn.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	defer conn.Close()
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	if status.Code(err) != codes.Unauthenticated || errs.Code(ErrorFromGRPC(err)) != 401 {
+		t.Fatalf("expect Unauthenticated, got %v", err)
+	}
+
+	// mux端口同时提供http接口
+	h2cClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	for _, client := range []*http.Client{h2cClient, http.DefaultClient} {
+		rsp, err := client.Get("http://" + webLn.Addr().String() + "/hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if string(body) != "hello" {
+			t.Fatalf("unexpected body %s", body)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start should return after Shutdown")
+	}
+}
+
+func TestGRPCConfigValidate(t *testing.T) {
+	_, err := ParseConfig("otz_go.yaml", []byte(`server:
+  services:
+    - name: web
+      type: mux
+      address: 127.0.0.1:8080
+`))
+	if err == nil || !strings.Contains(err.Error(), "server.services[0].type: mux requires tls or transport.protocol h2c") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = ParseConfig("otz_go.yaml", []byte(`server:
+  services:
+    - name: web
+      type: thrift
+      address: 127.0.0.1:8080
+`))
+	if err == nil || !strings.Contains(err.Error(), `must be one of http, grpc, mux, got "thrift"`) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cfg, err := ParseConfig("otz_go.yaml", []byte("server:\n  ip: 127.0.0.1\n  port: 8080\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(WithLogger(logtest.New()), WithConfig(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RegisterService(&grpc_health_v1.Health_ServiceDesc, &testHealthServer{})
+	if err = s.Start(); err == nil || !strings.Contains(err.Error(), "no grpc service configured") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// testWatchServer Watch返回一次状态后保持stream直到release关闭
+type testWatchServer struct {
+	testHealthServer
+	release chan struct{}
+}
+
+func (h *testWatchServer) Watch(req *grpc_health_v1.HealthCheckRequest,
+	stream grpc_health_v1.Health_WatchServer) error {
+	if err := stream.Send(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}); err != nil {
+		return err
+	}
+	select {
+	case <-h.release:
+		return nil
+	case <-stream.Context().Done():
+		return stream.Context().Err()
+	}
+}
+
+func TestGRPCMuxShutdown(t *testing.T) {
+	cfg, err := ParseConfig("otz_go.yaml", []byte(`server:
+  services:
+    - name: web
+      type: mux
+      address: 127.0.0.1:0
+      transport:
+        protocol: h2c
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// start 启动mux服务并打开一个Watch stream
+	start := func() (*Server, *testWatchServer, grpc_health_v1.Health_WatchClient) {
+		ln, _ := net.Listen("tcp", "127.0.0.1:0")
+		s, err := New(WithConfig(cfg), WithLogger(logtest.New()), WithServiceListener("web", ln))
+		if err != nil {
+			t.Fatal(err)
+		}
+		health := &testWatchServer{release: make(chan struct{})}
+		grpc_health_v1.RegisterHealthServer(s.Service("web"), health)
+		go func() {
+			_ = s.Start()
+		}()
+		conn, err := grpc.Dial(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			conn.Close()
+		})
+		stream, err := grpc_health_v1.NewHealthClient(conn).Watch(context.Background(),
+			&grpc_health_v1.HealthCheckRequest{}, grpc.WaitForReady(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = stream.Recv(); err != nil {
+			t.Fatal(err)
+		}
+		return s, health, stream
+	}
+
+	// 停止时等待处理中的stream结束
+	s, health, stream := start()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+	select {
+	case err = <-done:
+		t.Fatalf("shutdown should wait for open stream, got %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(health.release)
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown should return after stream finished")
+	}
+	if _, err = stream.Recv(); err == nil {
+		t.Fatal("stream should be finished")
+	}
+
+	// 超时后强制停止处理中的stream
+	s, _, stream = start()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_ = s.Shutdown(ctx)
+	if _, err = stream.Recv(); err == nil {
+		t.Fatal("stream should be closed after shutdown timeout")
+	}
+}
@@ -0,0 +1,270 @@
+package otz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	HealthStatusOK   = "ok"
+	HealthStatusFail = "fail"
+
+	healthPath    = "/healthz"
+	readinessPath = "/readyz"
+	livenessPath  = "/livez"
+
+	defaultHealthCheckTimeout  = time.Second
+	defaultHealthCacheInterval = time.Second
+	defaultShutdownDelay       = 5 * time.Second
+)
+
+// HealthConfig 健康检查接口配置, 接口在Start时注册在第一个http服务上, 不经过拦截器
+// /livez 进程存活, /healthz 执行所有检查, /readyz 执行所有检查且停止服务开始后立即失败
+// 业务已注册同名路由时跳过该接口, 使用业务的实现
+type HealthConfig struct {
+	// Disable 不注册健康检查接口
+	Disable bool `yaml:"disable"`
+	// CacheInterval 检查结果缓存时间, 避免探测过于频繁时压垮依赖, 默认1s
+	CacheInterval time.Duration `yaml:"cache_interval"`
+	// ShutdownDelay 停止服务时readyz先失败, 等待该时间让负载均衡摘除流量后再停止监听, 默认5s, 0不等待
+	// 包含在shutdown_timeout内, 框架的readyz从未被请求过(未配置就绪探测)时不等待
+	ShutdownDelay time.Duration `yaml:"shutdown_delay"`
+}
+
+// HealthCheck 健康检查项
+type HealthCheck struct {
+	Name string
+	// Check 检查函数, 返回nil表示正常, ctx在超时后取消
+	Check func(ctx context.Context) error
+	// Timeout 检查超时时间, 默认1s
+	Timeout time.Duration
+	// Critical 关键依赖, 检查失败时healthz及readyz返回503, 否则只在结果中展示
+	Critical bool
+}
+
+// HealthResult 单项检查结果
+type HealthResult struct {
+	Name       string    `json:"name"`
+	Status     string    `json:"status"`
+	Critical   bool      `json:"critical"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+	CheckedAt  time.Time `json:"checked_at"`
+}
+
+// HealthReport 健康检查报告, Status为fail时接口返回503
+type HealthReport struct {
+	Status string         `json:"status"`
+	Reason string         `json:"reason,omitempty"`
+	Checks []HealthResult `json:"checks"`
+}
+
+// healthCheck 带缓存的检查项, 同一时间只执行一次检查
+type healthCheck struct {
+	HealthCheck
+	mutex   sync.Mutex
+	result  HealthResult
+	expire  time.Time
+	running chan struct{} // 正在执行的检查, 完成时关闭
+}
+
+// run 返回缓存的结果或执行检查, 检查函数不响应ctx时超时返回失败, 不会重复启动检查
+func (c *healthCheck) run(cacheInterval time.Duration) HealthResult {
+	c.mutex.Lock()
+	if time.Now().Before(c.expire) {
+		defer c.mutex.Unlock()
+		return c.result
+	}
+	if c.running == nil {
+		done := make(chan struct{})
+		c.running = done
+		go func() {
+			begin := time.Now()
+			ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+			err := c.safeCheck(ctx)
+			cancel()
+			result := HealthResult{
+				Name:       c.Name,
+				Status:     HealthStatusOK,
+				Critical:   c.Critical,
+				DurationMs: time.Since(begin).Milliseconds(),
+				CheckedAt:  begin,
+			}
+			if err != nil {
+				result.Status, result.Error = HealthStatusFail, err.Error()
+			}
+			c.mutex.Lock()
+			c.result, c.expire, c.running = result, time.Now().Add(cacheInterval), nil
+			c.mutex.Unlock()
+			close(done)
+		}()
+	}
+	running := c.running
+	c.mutex.Unlock()
+
+	timer := time.NewTimer(c.Timeout)
+	defer timer.Stop()
+	select {
+	case <-running:
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		return c.result
+	case <-timer.C:
+		return HealthResult{
+			Name:       c.Name,
+			Status:     HealthStatusFail,
+			Critical:   c.Critical,
+			Error:      fmt.Sprintf("timeout after %s", c.Timeout),
+			DurationMs: c.Timeout.Milliseconds(),
+			CheckedAt:  time.Now().Add(-c.Timeout),
+		}
+	}
+}
+
+func (c *healthCheck) safeCheck(ctx context.Context) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("panic: %v", e)
+		}
+	}()
+	return c.Check(ctx)
+}
+
+// health 服务的健康检查项及状态
+type health struct {
+	mutex sync.RWMutex
+	// checks 按名称排序, 修改时创建新的slice, 读取方持有的slice不会被修改
+	checks       []*healthCheck
+	shuttingDown int32
+	probed       int32 // readyz是否被请求过, 没有就绪探测时停止服务不需要等待摘除流量
+}
+
+// RegisterHealthCheck 注册健康检查项, 同名检查项会被替换
+func (s *Server) RegisterHealthCheck(check HealthCheck) error {
+	if check.Name == "" || check.Check == nil {
+		return errors.New("health check name and check func are required")
+	}
+	if check.Timeout <= 0 {
+		check.Timeout = defaultHealthCheckTimeout
+	}
+	s.health.mutex.Lock()
+	defer s.health.mutex.Unlock()
+	checks := make([]*healthCheck, 0, len(s.health.checks)+1)
+	for _, c := range s.health.checks {
+		if c.Name != check.Name {
+			checks = append(checks, c)
+		}
+	}
+	checks = append(checks, &healthCheck{HealthCheck: check})
+	sort.Slice(checks, func(i, j int) bool {
+		return checks[i].Name < checks[j].Name
+	})
+	s.health.checks = checks
+	return nil
+}
+
+// CheckHealth 并发执行所有检查项, readiness为true时停止服务开始后直接返回失败
+func (s *Server) CheckHealth(readiness bool) HealthReport {
+	if readiness && atomic.LoadInt32(&s.health.shuttingDown) == 1 {
+		return HealthReport{Status: HealthStatusFail, Reason: "shutting down", Checks: []HealthResult{}}
+	}
+	s.health.mutex.RLock()
+	checks := s.health.checks
+	s.health.mutex.RUnlock()
+	cacheInterval := s.cfg.Server.Health.CacheInterval
+	if cacheInterval <= 0 {
+		cacheInterval = defaultHealthCacheInterval
+	}
+
+	report := HealthReport{Status: HealthStatusOK, Checks: make([]HealthResult, len(checks))}
+	wg := sync.WaitGroup{}
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c *healthCheck) {
+			defer wg.Done()
+			report.Checks[i] = c.run(cacheInterval)
+		}(i, c)
+	}
+	wg.Wait()
+	for _, r := range report.Checks {
+		if r.Status == HealthStatusFail && r.Critical {
+			report.Status = HealthStatusFail
+			report.Reason = "critical check failed"
+		}
+	}
+	return report
+}
+
+// registerHealth 在第一个http服务上注册健康检查接口, 在Start时调用, 业务已注册的路由不覆盖
+func (s *Server) registerHealth() {
+	if s.cfg.Server.Health.Disable {
+		return
+	}
+	for _, svc := range s.services {
+		if svc.cfg.serviceType() == ServiceTypeGRPC {
+			continue
+		}
+		registered := map[string]bool{}
+		for _, route := range svc.engine.Routes() {
+			if route.Method == http.MethodGet {
+				registered[route.Path] = true
+			}
+		}
+		handlers := map[string]gin.HandlerFunc{
+			livenessPath: func(ginCtx *gin.Context) {
+				ginCtx.JSON(http.StatusOK, HealthReport{Status: HealthStatusOK, Checks: []HealthResult{}})
+			},
+			healthPath:    s.healthHandler(false),
+			readinessPath: s.healthHandler(true),
+		}
+		for _, path := range []string{livenessPath, healthPath, readinessPath} {
+			if registered[path] {
+				s.infof("service %s already registered %s, skip health probe", svc.cfg.Name, path)
+				continue
+			}
+			svc.engine.GET(path, handlers[path])
+		}
+		return
+	}
+}
+
+func (s *Server) healthHandler(readiness bool) gin.HandlerFunc {
+	return func(ginCtx *gin.Context) {
+		if readiness {
+			atomic.StoreInt32(&s.health.probed, 1)
+		}
+		report := s.CheckHealth(readiness)
+		code := http.StatusOK
+		if report.Status != HealthStatusOK {
+			code = http.StatusServiceUnavailable
+			s.warnf("%s failed, reason: %s", ginCtx.Request.URL.Path, report.Reason)
+		}
+		ginCtx.JSON(code, report)
+	}
+}
+
+// drain 标记服务停止中使readyz失败, 等待shutdown_delay后返回, ctx结束时提前返回
+// readyz从未被请求过时没有探测方需要感知, 不等待
+func (s *Server) drain(ctx context.Context) {
+	if !atomic.CompareAndSwapInt32(&s.health.shuttingDown, 0, 1) {
+		return
+	}
+	delay := s.cfg.Server.Health.ShutdownDelay
+	if delay <= 0 || atomic.LoadInt32(&s.health.probed) == 0 {
+		return
+	}
+	s.infof("readiness failing, wait %s for traffic draining", delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
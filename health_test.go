@@ -0,0 +1,207 @@
+package otz
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/ShadowsGtt/otz/log/logtest"
+	"github.com/ShadowsGtt/otz/otzctx"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	cfg, err := ParseConfig("otz_go.yaml", []byte(`server:
+  ip: 127.0.0.1
+  port: 8080
+  health:
+    cache_interval: 50ms
+    shutdown_delay: 100ms
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(WithConfig(cfg), WithLogger(logtest.New()), WithListener(ln))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dbCalls int32
+	var dbErr atomic.Value
+	dbErr.Store("")
+	_ = s.RegisterHealthCheck(HealthCheck{Name: "db", Critical: true, Check: func(ctx context.Context) error {
+		atomic.AddInt32(&dbCalls, 1)
+		if msg := dbErr.Load().(string); msg != "" {
+			return errors.New(msg)
+		}
+		return nil
+	}})
+	_ = s.RegisterHealthCheck(HealthCheck{Name: "cache", Timeout: 20 * time.Millisecond, Check: func(ctx context.Context) error {
+		// 不响应ctx的检查超时返回失败
+		time.Sleep(time.Second)
+		return nil
+	}})
+	if err = s.RegisterHealthCheck(HealthCheck{Name: "bad"}); err == nil {
+		t.Fatal("check func is required")
+	}
+	// 探测接口在Start时注册
+	go func() {
+		_ = s.Start()
+	}()
+	url := "http://" + ln.Addr().String()
+	for i := 0; i < 50; i++ {
+		if _, err = http.Get(url + "/livez"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) (int, HealthReport) {
+		w := httptest.NewRecorder()
+		s.services[0].engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		report := HealthReport{}
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, report
+	}
+	code, report := get("/readyz")
+	if code != http.StatusOK || report.Status != HealthStatusOK || len(report.Checks) != 2 {
+		t.Fatalf("unexpected report %d %+v", code, report)
+	}
+	if c := report.Checks[0]; c.Name != "cache" || c.Status != HealthStatusFail || c.Error != "timeout after 20ms" {
+		t.Fatalf("non-critical check should fail by timeout: %+v", c)
+	}
+	if c := report.Checks[1]; c.Name != "db" || c.Status != HealthStatusOK || !c.Critical {
+		t.Fatalf("unexpected check %+v", c)
+	}
+
+	// 缓存时间内不重复检查
+	dbErr.Store("connection refused")
+	if code, _ = get("/healthz"); code != http.StatusOK || atomic.LoadInt32(&dbCalls) != 1 {
+		t.Fatalf("result should be cached, code %d, calls %d", code, dbCalls)
+	}
+	time.Sleep(60 * time.Millisecond)
+	code, report = get("/healthz")
+	if code != http.StatusServiceUnavailable || report.Checks[1].Error != "connection refused" {
+		t.Fatalf("critical check failure should return 503, got %d %+v", code, report)
+	}
+	dbErr.Store("")
+	time.Sleep(60 * time.Millisecond)
+
+	// 停止服务时readyz立即失败, 延迟期间继续处理请求
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+	time.Sleep(20 * time.Millisecond)
+	rsp, err := http.Get(url + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("readyz should fail after shutdown started, got %d", rsp.StatusCode)
+	}
+	if rsp, err = http.Get(url + "/healthz"); err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("healthz should not be affected by shutdown, got %d", rsp.StatusCode)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHealthRegisterConcurrent(t *testing.T) {
+	cfg, err := ParseConfig("otz_go.yaml", []byte("server:\n  ip: 127.0.0.1\n  port: 8080\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(WithConfig(cfg), WithLogger(logtest.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(ctx context.Context) error { return nil }
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = s.RegisterHealthCheck(HealthCheck{Name: string(rune('a' + i%26)), Check: check})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		s.CheckHealth(false)
+	}
+	<-done
+	if report := s.CheckHealth(false); len(report.Checks) != 26 || report.Checks[0].Name != "a" {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
+
+func TestHealthCustomRoute(t *testing.T) {
+	cfg, err := ParseConfig("otz_go.yaml", []byte("server:\n  ip: 127.0.0.1\n  port: 8080\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(WithConfig(cfg), WithLogger(logtest.New()), WithListener(ln))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 业务已实现的探测接口不被覆盖, 启动不panic
+	s.Register("/healthz", func(ctx context.Context) {
+		otzctx.OTZContext(ctx).GetGinCtx().String(http.StatusOK, "custom")
+	})
+	go func() {
+		_ = s.Start()
+	}()
+	url := "http://" + ln.Addr().String()
+	var rsp *http.Response
+	for i := 0; i < 50; i++ {
+		if rsp, err = http.Get(url + "/healthz"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if string(body) != "custom" {
+		t.Fatalf("custom healthz should be kept, got %s", body)
+	}
+	if rsp, err = http.Get(url + "/readyz"); err != nil || rsp.StatusCode != http.StatusOK {
+		t.Fatalf("readyz should be registered, got %v %v", rsp, err)
+	}
+	rsp.Body.Close()
+
+	// 默认shutdown_delay为5s, readyz被探测过, 停止时等待摘除流量直到ctx超时
+	if cfg.Server.Health.ShutdownDelay != defaultShutdownDelay {
+		t.Fatalf("unexpected default shutdown delay %s", cfg.Server.Health.ShutdownDelay)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	_ = s.Shutdown(ctx)
+	if time.Since(begin) < 100*time.Millisecond {
+		t.Fatal("shutdown should wait for draining after readyz probed")
+	}
+}
@@ -0,0 +1,191 @@
+package log
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/ShadowsGtt/otz/otzctx"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultEscalationHeader = "X-Otz-Log-Level"
+	defaultUserIDHeader     = "X-User-Id"
+)
+
+// EscalationConfig 请求级日志等级提升配置
+type EscalationConfig struct {
+	Secret       string `yaml:"secret"`         // 签名header的密钥, 为空则不接受签名header
+	Header       string `yaml:"header"`         // 签名header名, 默认X-Otz-Log-Level
+	UserIDHeader string `yaml:"user_id_header"` // 用户ID所在header, 默认X-User-Id
+}
+
+// LevelRule 日志等级提升规则, 命中规则的请求使用规则中的等级
+type LevelRule struct {
+	ID       string    `json:"id"`
+	UserID   string    `json:"user_id"`   // 用户ID, 为空不限制
+	Path     string    `json:"path"`      // 请求路径前缀, 为空不限制
+	Level    string    `json:"level"`     // 日志等级, 默认debug
+	ExpireAt time.Time `json:"expire_at"` // 过期时间
+}
+
+func (r *LevelRule) match(userID, path string) bool {
+	if r.UserID != "" && r.UserID != userID {
+		return false
+	}
+	if r.Path != "" && !strings.HasPrefix(path, r.Path) {
+		return false
+	}
+	return true
+}
+
+var (
+	escalation      = EscalationConfig{Header: defaultEscalationHeader, UserIDHeader: defaultUserIDHeader}
+	levelRules      = map[string]*LevelRule{}
+	escalationMutex sync.RWMutex
+)
+
+// SetEscalation 设置日志等级提升配置
+func SetEscalation(cfg EscalationConfig) {
+	if cfg.Header == "" {
+		cfg.Header = defaultEscalationHeader
+	}
+	if cfg.UserIDHeader == "" {
+		cfg.UserIDHeader = defaultUserIDHeader
+	}
+	escalationMutex.Lock()
+	defer escalationMutex.Unlock()
+	escalation = cfg
+}
+
+// AddLevelRule 添加日志等级提升规则, 返回规则ID
+func AddLevelRule(rule LevelRule) (string, error) {
+	if rule.Level == "" {
+		rule.Level = LevelDebug.String()
+	}
+	if _, ok := ParseLevel(rule.Level); !ok {
+		return "", fmt.Errorf("invalid log level: %s", rule.Level)
+	}
+	if rule.UserID == "" && rule.Path == "" {
+		return "", fmt.Errorf("user_id or path is required")
+	}
+	if !rule.ExpireAt.After(time.Now()) {
+		return "", fmt.Errorf("expire_at must be in the future")
+	}
+	if rule.ID == "" {
+		rule.ID = newRuleID()
+	}
+	escalationMutex.Lock()
+	defer escalationMutex.Unlock()
+	levelRules[rule.ID] = &rule
+	return rule.ID, nil
+}
+
+// RemoveLevelRule 删除日志等级提升规则
+func RemoveLevelRule(id string) bool {
+	escalationMutex.Lock()
+	defer escalationMutex.Unlock()
+	_, ok := levelRules[id]
+	delete(levelRules, id)
+	return ok
+}
+
+// LevelRules 获取未过期的日志等级提升规则, 同时清理已过期规则
+func LevelRules() []LevelRule {
+	escalationMutex.Lock()
+	defer escalationMutex.Unlock()
+	now := time.Now()
+	rules := make([]LevelRule, 0, len(levelRules))
+	for id, r := range levelRules {
+		if !r.ExpireAt.After(now) {
+			delete(levelRules, id)
+			continue
+		}
+		rules = append(rules, *r)
+	}
+	return rules
+}
+
+// MatchLevelRule 按用户ID和路径匹配规则, 命中多条时取最低等级
+func MatchLevelRule(userID, path string) (Level, bool) {
+	escalationMutex.RLock()
+	defer escalationMutex.RUnlock()
+	now := time.Now()
+	matched := LevelNil
+	for _, r := range levelRules {
+		if !r.ExpireAt.After(now) || !r.match(userID, path) {
+			continue
+		}
+		level, _ := ParseLevel(r.Level)
+		if matched == LevelNil || level < matched {
+			matched = level
+		}
+	}
+	return matched, matched != LevelNil
+}
+
+// SignLevel 生成签名header的值, 格式: level.过期时间戳.签名
+func SignLevel(secret string, level Level, expireAt time.Time) string {
+	payload := level.String() + "." + strconv.FormatInt(expireAt.Unix(), 10)
+	return payload + "." + sign(secret, payload)
+}
+
+// VerifyLevel 校验签名header, 返回header中的日志等级
+func VerifyLevel(secret, value string) (Level, bool) {
+	if secret == "" || value == "" {
+		return LevelNil, false
+	}
+	idx := strings.LastIndexByte(value, '.')
+	if idx == -1 {
+		return LevelNil, false
+	}
+	payload, signature := value[:idx], value[idx+1:]
+	if !hmac.Equal([]byte(signature), []byte(sign(secret, payload))) {
+		return LevelNil, false
+	}
+	parts := strings.SplitN(payload, ".", 2)
+	if len(parts) != 2 {
+		return LevelNil, false
+	}
+	expire, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expire {
+		return LevelNil, false
+	}
+	return ParseLevel(parts[0])
+}
+
+func sign(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newRuleID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// escalatedLevel 计算当前请求需要提升到的日志等级
+func escalatedLevel(otzCtx otzctx.Context) (Level, bool) {
+	path := ""
+	if ginCtx := otzCtx.GetGinCtx(); ginCtx != nil && ginCtx.Request != nil {
+		path = ginCtx.Request.URL.Path
+	} else if req := otzCtx.GetRequest(); req != nil {
+		path = req.Route
+	} else {
+		return LevelNil, false
+	}
+	escalationMutex.RLock()
+	cfg := escalation
+	escalationMutex.RUnlock()
+	if level, ok := VerifyLevel(cfg.Secret, requestHeader(otzCtx, cfg.Header)); ok {
+		return level, true
+	}
+	return MatchLevelRule(requestHeader(otzCtx, cfg.UserIDHeader), path)
+}
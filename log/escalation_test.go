@@ -0,0 +1,95 @@
+package log_test
+
+import (
+	"context"
+	"github.com/ShadowsGtt/otz/log"
+	"github.com/ShadowsGtt/otz/otzctx"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignLevel(t *testing.T) {
+	value := log.SignLevel("secret", log.LevelDebug, time.Now().Add(time.Minute))
+	if level, ok := log.VerifyLevel("secret", value); !ok || level != log.LevelDebug {
+		t.Fatalf("verify failed, level: %s, ok: %v", level, ok)
+	}
+	if _, ok := log.VerifyLevel("other", value); ok {
+		t.Fatal("verify should fail with wrong secret")
+	}
+	expired := log.SignLevel("secret", log.LevelDebug, time.Now().Add(-time.Minute))
+	if _, ok := log.VerifyLevel("secret", expired); ok {
+		t.Fatal("verify should fail when expired")
+	}
+}
+
+func TestLevelRule(t *testing.T) {
+	if _, err := log.AddLevelRule(log.LevelRule{UserID: "u1", ExpireAt: time.Now().Add(-time.Second)}); err == nil {
+		t.Fatal("expired rule should be rejected")
+	}
+	id, err := log.AddLevelRule(log.LevelRule{UserID: "u1", Path: "/api", ExpireAt: time.Now().Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.RemoveLevelRule(id)
+
+	if level, ok := log.MatchLevelRule("u1", "/api/order"); !ok || level != log.LevelDebug {
+		t.Fatalf("rule should match, level: %s, ok: %v", level, ok)
+	}
+	if _, ok := log.MatchLevelRule("u2", "/api/order"); ok {
+		t.Fatal("rule should not match other user")
+	}
+	if _, ok := log.MatchLevelRule("u1", "/admin"); ok {
+		t.Fatal("rule should not match other path")
+	}
+	if n := len(log.LevelRules()); n != 1 {
+		t.Fatalf("expected 1 rule, got %d", n)
+	}
+}
+
+func TestWithCtxEscalation(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "escalation.log")
+	prev := log.GetDefaultLogger()
+	defer log.SetDefaultLogger(prev)
+	log.SetDefault(log.Config{
+		OutputType: log.OutputTypeFile,
+		FileName:   fileName,
+		Level:      "info",
+	})
+	log.SetEscalation(log.EscalationConfig{Secret: "secret"})
+	defer log.SetEscalation(log.EscalationConfig{})
+
+	newCtx := func(header string) context.Context {
+		ginCtx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ginCtx.Request = httptest.NewRequest(http.MethodGet, "/api/order", nil)
+		ginCtx.Request.Header.Set("X-Otz-Log-Level", header)
+		otzCtx := otzctx.NewOtzContext(context.Background())
+		otzCtx.SetGinCtx(ginCtx)
+		return log.WithCtx(otzCtx.Context())
+	}
+	log.DebugCtx(newCtx(""), "plain request")
+	log.DebugCtx(newCtx("debug.1.invalid"), "forged request")
+	log.DebugCtx(newCtx(log.SignLevel("secret", log.LevelDebug, time.Now().Add(time.Minute))), "signed request")
+	log.Debug("global debug")
+	if err := log.GetDefaultLogger().Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(content)
+	if strings.Contains(out, "plain request") || strings.Contains(out, "forged request") ||
+		strings.Contains(out, "global debug") {
+		t.Fatalf("unexpected debug log: %s", out)
+	}
+	if !strings.Contains(out, "signed request") {
+		t.Fatalf("signed request debug log missing: %s", out)
+	}
+}
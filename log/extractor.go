@@ -0,0 +1,164 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"github.com/ShadowsGtt/otz/otzctx"
+	"go.opentelemetry.io/otel/trace"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// RequestIDHeader 请求ID所在header
+	RequestIDHeader = "X-Request-Id"
+
+	FieldRequestID = "request_id"
+	FieldUserID    = "user_id"
+	FieldClientIP  = "client_ip"
+	FieldRoute     = "route"
+	FieldTraceID   = "trace_id"
+	FieldSpanID    = "span_id"
+)
+
+// FieldExtractor 从otz ctx中提取日志字段, 返回key/value交替的字段
+type FieldExtractor func(ctx otzctx.Context) []string
+
+type namedExtractor struct {
+	name string
+	fn   FieldExtractor
+}
+
+var (
+	extractors       = map[string]FieldExtractor{}
+	extractorMutex   sync.Mutex
+	activeExtractors atomic.Value // []namedExtractor
+)
+
+func init() {
+	activeExtractors.Store([]namedExtractor{})
+	RegisterFieldExtractor(FieldRequestID, func(ctx otzctx.Context) []string {
+		return headerField(ctx, FieldRequestID, RequestIDHeader)
+	})
+	RegisterFieldExtractor(FieldUserID, func(ctx otzctx.Context) []string {
+		escalationMutex.RLock()
+		header := escalation.UserIDHeader
+		escalationMutex.RUnlock()
+		return headerField(ctx, FieldUserID, header)
+	})
+	RegisterFieldExtractor(FieldClientIP, func(ctx otzctx.Context) []string {
+		if ginCtx := ctx.GetGinCtx(); ginCtx != nil && ginCtx.Request != nil {
+			return []string{FieldClientIP, ginCtx.ClientIP()}
+		}
+		if req := ctx.GetRequest(); req != nil && req.ClientIP != "" {
+			return []string{FieldClientIP, req.ClientIP}
+		}
+		return nil
+	})
+	RegisterFieldExtractor(FieldRoute, func(ctx otzctx.Context) []string {
+		if ginCtx := ctx.GetGinCtx(); ginCtx != nil && ginCtx.FullPath() != "" {
+			return []string{FieldRoute, ginCtx.FullPath()}
+		}
+		if req := ctx.GetRequest(); req != nil && req.Route != "" {
+			return []string{FieldRoute, req.Route}
+		}
+		return nil
+	})
+}
+
+func headerField(ctx otzctx.Context, key, header string) []string {
+	value := requestHeader(ctx, header)
+	if value == "" {
+		return nil
+	}
+	return []string{key, value}
+}
+
+// requestHeader 获取请求头, http请求从gin ctx获取, 其他协议从Request获取
+func requestHeader(ctx otzctx.Context, header string) string {
+	if ginCtx := ctx.GetGinCtx(); ginCtx != nil && ginCtx.Request != nil {
+		return ginCtx.GetHeader(header)
+	}
+	return ctx.GetRequest().GetHeader(header)
+}
+
+// RegisterFieldExtractor 注册字段提取器, 需通过EnableFieldExtractors开启, 同名会被替换
+func RegisterFieldExtractor(name string, fn FieldExtractor) {
+	extractorMutex.Lock()
+	defer extractorMutex.Unlock()
+	extractors[name] = fn
+	// 已开启的同名提取器同步替换
+	active := activeExtractors.Load().([]namedExtractor)
+	updated := make([]namedExtractor, len(active))
+	for i, e := range active {
+		if e.name == name {
+			e.fn = fn
+		}
+		updated[i] = e
+	}
+	activeExtractors.Store(updated)
+}
+
+// FieldExtractorRegistered 提取器是否已注册, 用于开启前校验配置
+func FieldExtractorRegistered(name string) bool {
+	extractorMutex.Lock()
+	defer extractorMutex.Unlock()
+	_, ok := extractors[name]
+	return ok
+}
+
+// EnableFieldExtractors 按顺序开启字段提取器, 替换已开启的提取器
+// 开启后在创建请求的logger(WithCtx)时执行提取器并追加字段, 同一请求只执行一次
+func EnableFieldExtractors(names ...string) error {
+	extractorMutex.Lock()
+	defer extractorMutex.Unlock()
+	active := make([]namedExtractor, 0, len(names))
+	for _, name := range names {
+		fn, ok := extractors[name]
+		if !ok {
+			return fmt.Errorf("log field extractor %s not registered", name)
+		}
+		active = append(active, namedExtractor{name: name, fn: fn})
+	}
+	activeExtractors.Store(active)
+	return nil
+}
+
+// extractFields 执行已开启的字段提取器
+func extractFields(otzCtx otzctx.Context) []string {
+	active := activeExtractors.Load().([]namedExtractor)
+	if len(active) == 0 {
+		return nil
+	}
+	fields := []string{}
+	for _, e := range active {
+		fields = append(fields, e.fn(otzCtx)...)
+	}
+	return fields
+}
+
+// ctxLogger 获取ctx中请求的logger, 未通过WithCtx创建时使用默认logger并追加提取器字段
+func ctxLogger(ctx context.Context) Logger {
+	otzCtx := otzctx.OTZContext(ctx)
+	logger, ok := otzCtx.GetLogger().(Logger)
+	if !ok || logger == nil {
+		logger = requestLogger(otzCtx, GetDefaultLogger(), nil)
+	}
+	if fields := traceFields(ctx, otzCtx); len(fields) > 0 {
+		logger = logger.With(fields...)
+	}
+	return logger
+}
+
+// traceFields 业务创建的子span中输出日志时追加子span的trace_id及span_id, 不需要配置log_fields
+// 请求的span已由WithSpanCtx追加到请求的logger
+func traceFields(ctx context.Context, otzCtx otzctx.Context) []string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return nil
+	}
+	if span := otzCtx.GetSpan(); span != nil && span.SpanContext().Equal(sc) {
+		return nil
+	}
+	return []string{FieldTraceID, sc.TraceID().String(), FieldSpanID, sc.SpanID().String()}
+}
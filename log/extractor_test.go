@@ -0,0 +1,61 @@
+package log_test
+
+import (
+	"context"
+	"github.com/ShadowsGtt/otz/log"
+	"github.com/ShadowsGtt/otz/log/logtest"
+	"github.com/ShadowsGtt/otz/otzctx"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFieldExtractor(t *testing.T) {
+	if err := log.EnableFieldExtractors("not_exist"); err == nil {
+		t.Fatal("unknown extractor should be rejected")
+	}
+	calls := 0
+	log.RegisterFieldExtractor("tenant", func(ctx otzctx.Context) []string {
+		calls++
+		return []string{"tenant", "t1"}
+	})
+	if err := log.EnableFieldExtractors(log.FieldRequestID, log.FieldUserID, log.FieldClientIP, "tenant"); err != nil {
+		t.Fatal(err)
+	}
+	defer log.EnableFieldExtractors()
+
+	ginCtx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ginCtx.Request = httptest.NewRequest(http.MethodGet, "/api/order", nil)
+	ginCtx.Request.Header.Set(log.RequestIDHeader, "req-1")
+	ginCtx.Request.RemoteAddr = "10.0.0.1:1234"
+	// 创建请求的logger时执行提取器
+	otzCtx := otzctx.NewOtzContext(context.Background())
+	otzCtx.SetGinCtx(ginCtx)
+	r := logtest.New()
+	ctx := log.WithLoggerCtx(otzCtx.Context(), r)
+
+	log.InfoCtxf(ctx, "with fields")
+	log.InfoCtxf(ctx, "with fields again")
+	if calls != 1 {
+		t.Fatalf("extractor should run once per request, got %d", calls)
+	}
+	e := r.AssertLogged(t, log.LevelInfo, "with fields")
+	if e.Fields[log.FieldRequestID] != "req-1" || e.Fields[log.FieldClientIP] != "10.0.0.1" ||
+		e.Fields["tenant"] != "t1" {
+		t.Fatalf("unexpected fields: %v", e.Fields)
+	}
+	if _, ok := e.Fields[log.FieldUserID]; ok {
+		t.Fatalf("user_id should be skipped when header is missing: %v", e.Fields)
+	}
+
+	// 未开启时不追加字段
+	log.EnableFieldExtractors()
+	otzCtx = otzctx.NewOtzContext(context.Background())
+	otzCtx.SetGinCtx(ginCtx)
+	ctx = log.WithLoggerCtx(otzCtx.Context(), r)
+	log.InfoCtx(ctx, "without fields")
+	if e = r.AssertLogged(t, log.LevelInfo, "without fields"); len(e.Fields) != 0 {
+		t.Fatalf("unexpected fields: %v", e.Fields)
+	}
+}
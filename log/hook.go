@@ -0,0 +1,326 @@
+package log
+
+import (
+	"fmt"
+	"go.uber.org/zap/zapcore"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultHookQueueSize = 1024
+	hookDrainTimeout     = time.Second
+)
+
+// Entry 日志记录, 传递给Hook
+type Entry struct {
+	Time     time.Time
+	Level    Level
+	Message  string
+	Fields   map[string]string
+	Caller   string
+	Repeated int // 去重窗口内被合并的相同日志条数
+}
+
+// Hook 日志回调
+type Hook interface {
+	Fire(e Entry) error
+}
+
+// HookFunc 函数形式的日志回调
+type HookFunc func(e Entry) error
+
+// Fire 执行回调
+func (f HookFunc) Fire(e Entry) error {
+	return f(e)
+}
+
+// Flusher 有缓冲的Hook实现, fatal退出前会调用
+type Flusher interface {
+	Flush() error
+}
+
+// HookOptions 回调选项
+type HookOptions struct {
+	Level       Level         // 最低触发等级, 默认error
+	QueueSize   int           // 异步队列长度, 默认1024, 队列满时丢弃
+	DedupWindow time.Duration // 相同等级/内容/调用位置在窗口内只回调一次, 为0不去重
+	RateLimit   int           // 每秒最多回调次数, 为0不限制
+}
+
+// hookRunner 异步执行单个hook
+type hookRunner struct {
+	name    string
+	hook    Hook
+	opts    HookOptions
+	queue   chan Entry
+	pending sync.WaitGroup
+	done    chan struct{}
+
+	// 以下字段只在入队时访问, 由mutex保护
+	mutex       sync.Mutex
+	lastFired   map[string]time.Time
+	repeated    map[string]int
+	windowStart time.Time
+	windowCount int
+}
+
+var (
+	hooks        = map[string]*hookRunner{}
+	hookMutex    sync.RWMutex
+	minHookLevel int32 = int32(LevelNil) // 所有hook的最低等级, 没有hook时为LevelNil
+)
+
+// AddHook 添加日志回调, 同名hook会被替换
+func AddHook(name string, hook Hook, opts HookOptions) {
+	if opts.Level == LevelNil {
+		opts.Level = LevelError
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaultHookQueueSize
+	}
+	r := &hookRunner{
+		name:      name,
+		hook:      hook,
+		opts:      opts,
+		queue:     make(chan Entry, opts.QueueSize),
+		done:      make(chan struct{}),
+		lastFired: map[string]time.Time{},
+		repeated:  map[string]int{},
+	}
+	go r.run()
+
+	hookMutex.Lock()
+	old := hooks[name]
+	hooks[name] = r
+	updateMinHookLevel()
+	hookMutex.Unlock()
+	if old != nil {
+		old.stop()
+	}
+}
+
+// RemoveHook 删除日志回调, 等待已入队的日志处理完成, hook实现io.Closer时会被关闭
+func RemoveHook(name string) {
+	hookMutex.Lock()
+	r := hooks[name]
+	delete(hooks, name)
+	updateMinHookLevel()
+	hookMutex.Unlock()
+	if r != nil {
+		r.stop()
+	}
+}
+
+// FlushHooks 等待所有hook处理完已入队的日志, 最多等待timeout
+func FlushHooks(timeout time.Duration) {
+	hookMutex.RLock()
+	runners := make([]*hookRunner, 0, len(hooks))
+	for _, r := range hooks {
+		runners = append(runners, r)
+	}
+	hookMutex.RUnlock()
+
+	done := make(chan struct{})
+	go func() {
+		for _, r := range runners {
+			r.pending.Wait()
+			if f, ok := r.hook.(Flusher); ok {
+				if err := f.Flush(); err != nil {
+					fmt.Fprintf(os.Stderr, "log hook %s flush failed, err: %v\n", r.name, err)
+				}
+			}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+// updateMinHookLevel 需持有hookMutex写锁
+func updateMinHookLevel() {
+	level := LevelNil
+	for _, r := range hooks {
+		if level == LevelNil || r.opts.Level < level {
+			level = r.opts.Level
+		}
+	}
+	atomic.StoreInt32(&minHookLevel, int32(level))
+}
+
+func hookEnabled(level Level) bool {
+	min := Level(atomic.LoadInt32(&minHookLevel))
+	return min != LevelNil && level >= min
+}
+
+func fireHooks(e Entry) {
+	hookMutex.RLock()
+	defer hookMutex.RUnlock()
+	for _, r := range hooks {
+		r.enqueue(e)
+	}
+}
+
+func (r *hookRunner) enqueue(e Entry) {
+	if e.Level < r.opts.Level {
+		return
+	}
+	r.mutex.Lock()
+	if !r.allow(&e) {
+		r.mutex.Unlock()
+		return
+	}
+	r.pending.Add(1)
+	r.mutex.Unlock()
+
+	select {
+	case r.queue <- e:
+	default:
+		// 队列满时丢弃, 不能阻塞业务日志
+		r.pending.Done()
+	}
+}
+
+// allow 去重及限流, 需持有r.mutex
+func (r *hookRunner) allow(e *Entry) bool {
+	if r.opts.DedupWindow > 0 {
+		key := fmt.Sprintf("%d|%s|%s", e.Level, e.Message, e.Caller)
+		if last, ok := r.lastFired[key]; ok && e.Time.Sub(last) < r.opts.DedupWindow {
+			r.repeated[key]++
+			return false
+		}
+		r.lastFired[key] = e.Time
+		e.Repeated = r.repeated[key]
+		delete(r.repeated, key)
+		// 清理过期的去重记录, 避免无限增长
+		if len(r.lastFired) > r.opts.QueueSize {
+			for k, t := range r.lastFired {
+				if e.Time.Sub(t) >= r.opts.DedupWindow {
+					delete(r.lastFired, k)
+					delete(r.repeated, k)
+				}
+			}
+		}
+	}
+	if r.opts.RateLimit > 0 {
+		if e.Time.Sub(r.windowStart) >= time.Second {
+			r.windowStart = e.Time
+			r.windowCount = 0
+		}
+		if r.windowCount >= r.opts.RateLimit {
+			return false
+		}
+		r.windowCount++
+	}
+	return true
+}
+
+func (r *hookRunner) run() {
+	defer close(r.done)
+	for e := range r.queue {
+		if err := r.hook.Fire(e); err != nil {
+			// 不能使用日志输出, 避免错误日志再次触发hook
+			fmt.Fprintf(os.Stderr, "log hook %s fire failed, err: %v\n", r.name, err)
+		}
+		r.pending.Done()
+	}
+}
+
+// stop 调用前需已从hooks中移除, 入队均在hookMutex读锁内进行, 此时不会再有入队
+func (r *hookRunner) stop() {
+	close(r.queue)
+	<-r.done
+	var err error
+	if c, ok := r.hook.(io.Closer); ok {
+		err = c.Close()
+	} else if f, ok := r.hook.(Flusher); ok {
+		err = f.Flush()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "log hook %s stop failed, err: %v\n", r.name, err)
+	}
+}
+
+// hookCore 将达到hook等级的日志分发给hook
+type hookCore struct {
+	fields []zapcore.Field
+}
+
+// Enabled 是否有hook关注该等级
+func (c *hookCore) Enabled(l zapcore.Level) bool {
+	return hookEnabled(fromZapLevel(l))
+}
+
+// With 设置自定义字段
+func (c *hookCore) With(fields []zapcore.Field) zapcore.Core {
+	merged := make([]zapcore.Field, 0, len(c.fields)+len(fields))
+	merged = append(merged, c.fields...)
+	merged = append(merged, fields...)
+	return &hookCore{fields: merged}
+}
+
+// Check 检查是否回调
+func (c *hookCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+// Write 分发日志
+func (c *hookCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range c.fields {
+		f.AddTo(enc)
+	}
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	e := Entry{
+		Time:    ent.Time,
+		Level:   fromZapLevel(ent.Level),
+		Message: ent.Message,
+		Fields:  make(map[string]string, len(enc.Fields)),
+	}
+	for k, v := range enc.Fields {
+		e.Fields[k] = fmt.Sprint(v)
+	}
+	if ent.Caller.Defined {
+		e.Caller = ent.Caller.TrimmedPath()
+	}
+	fireHooks(e)
+	// fatal会直接退出进程, 需等待hook处理完成
+	if ent.Level > zapcore.ErrorLevel {
+		FlushHooks(hookDrainTimeout)
+	}
+	return nil
+}
+
+// Sync 无需刷新
+func (c *hookCore) Sync() error {
+	return nil
+}
+
+func fromZapLevel(l zapcore.Level) Level {
+	switch {
+	case l == TraceLevel:
+		return LevelTrace
+	case l == zapcore.DebugLevel:
+		return LevelDebug
+	case l == zapcore.InfoLevel:
+		return LevelInfo
+	case l == zapcore.WarnLevel:
+		return LevelWarn
+	case l == zapcore.ErrorLevel:
+		return LevelError
+	case l > zapcore.ErrorLevel:
+		return LevelFatal
+	default:
+		return LevelNil
+	}
+}
@@ -0,0 +1,126 @@
+package log_test
+
+import (
+	"encoding/json"
+	"github.com/ShadowsGtt/otz/log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setFileDefault 默认日志输出到临时文件, 避免污染控制台
+func setFileDefault(t *testing.T) {
+	prev := log.GetDefaultLogger()
+	log.SetDefault(log.Config{
+		OutputType: log.OutputTypeFile,
+		FileName:   filepath.Join(t.TempDir(), "hook.log"),
+		Level:      "debug",
+	})
+	t.Cleanup(func() {
+		log.SetDefaultLogger(prev)
+	})
+}
+
+func TestHook(t *testing.T) {
+	setFileDefault(t)
+	var mutex sync.Mutex
+	entries := []log.Entry{}
+	log.AddHook("test", log.HookFunc(func(e log.Entry) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		entries = append(entries, e)
+		return nil
+	}), log.HookOptions{Level: log.LevelWarn, DedupWindow: time.Minute})
+	defer log.RemoveHook("test")
+
+	log.Info("info is ignored")
+	log.With("order_id", "1").Warnf("warn %d", 1)
+	for i := 0; i < 3; i++ {
+		log.Error("duplicated error")
+	}
+	log.FlushHooks(time.Second)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d: %+v", len(entries), entries)
+	}
+	if entries[0].Level != log.LevelWarn || entries[0].Message != "warn 1" || entries[0].Fields["order_id"] != "1" {
+		t.Fatalf("unexpected entry: %+v", entries[0])
+	}
+	if entries[1].Level != log.LevelError || entries[1].Caller == "" {
+		t.Fatalf("unexpected entry: %+v", entries[1])
+	}
+}
+
+func TestHookRateLimit(t *testing.T) {
+	setFileDefault(t)
+	var mutex sync.Mutex
+	count := 0
+	log.AddHook("limit", log.HookFunc(func(e log.Entry) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		count++
+		return nil
+	}), log.HookOptions{RateLimit: 5})
+	defer log.RemoveHook("limit")
+
+	for i := 0; i < 20; i++ {
+		log.Errorf("error %d", i)
+	}
+	log.FlushHooks(time.Second)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if count != 5 {
+		t.Fatalf("expected 5 fired, got %d", count)
+	}
+}
+
+func TestWebhookHook(t *testing.T) {
+	setFileDefault(t)
+	payloads := make(chan log.WebhookPayload, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := log.WebhookPayload{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		if r.Header.Get("X-Token") != "token" {
+			t.Errorf("unexpected header: %v", r.Header)
+		}
+		payloads <- payload
+	}))
+	defer srv.Close()
+
+	_, err := log.SetupWebhook(log.WebhookConfig{
+		URL:      srv.URL,
+		Interval: time.Hour,
+		Headers:  map[string]string{"X-Token": "token"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.RemoveHook("webhook")
+
+	for i := 0; i < 3; i++ {
+		log.Error("db connect failed")
+	}
+	log.Warn("warn is ignored")
+	log.Errorf("order %s failed", "1")
+	log.FlushHooks(time.Second)
+
+	select {
+	case payload := <-payloads:
+		if payload.Total != 4 || len(payload.Alerts) != 2 {
+			t.Fatalf("unexpected payload: %+v", payload)
+		}
+		if a := payload.Alerts[0]; a.Message != "db connect failed" || a.Count != 3 || a.Level != "error" {
+			t.Fatalf("unexpected alert: %+v", a)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("webhook not received")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"github.com/ShadowsGtt/otz/otzctx"
+	"go.opentelemetry.io/otel/trace"
 	"sync"
 )
 
@@ -32,7 +33,7 @@ func SetDefaultWithLoader(parser Parser) error {
 	if err != nil {
 		return err
 	}
-	defaultLogger = NewZapLog(cfgs...)
+	SetDefaultLogger(NewZapLog(cfgs...))
 
 	return nil
 }
@@ -47,7 +48,7 @@ func SetDefaultWithParseSkip(parser Parser, skip int) error {
 	if err != nil {
 		return err
 	}
-	defaultLogger = NewZapLogWithSkip(skip, cfgs...)
+	SetDefaultLogger(NewZapLogWithSkip(skip, cfgs...))
 
 	return nil
 }
@@ -66,6 +67,13 @@ func SetDefaultWithSkip(skip int, cfgs ...Config) {
 	defaultLogger = NewZapLogWithSkip(skip, cfgs...)
 }
 
+// SetDefaultLogger 直接设置默认日志实例
+func SetDefaultLogger(logger Logger) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	defaultLogger = logger
+}
+
 // GetDefaultLogger 获取默认日志
 func GetDefaultLogger() Logger {
 	mutex.Lock()
@@ -106,13 +114,83 @@ func WithCtx(ctx context.Context, fields ...string) context.Context {
 	if ok && logger != nil {
 		logger = logger.With(fields...)
 	} else {
-		logger = GetDefaultLogger().With(fields...)
+		logger = requestLogger(otzCtx, GetDefaultLogger(), fields)
 	}
 	otzCtx.SetLogger(logger)
 
 	return ctx
 }
 
+// WithLoggerCtx 使用指定的logger作为ctx的日志, 替换已设置的logger, 用于同一进程中的多个服务各自输出日志
+// 命中签名header或规则的请求提升日志等级
+func WithLoggerCtx(ctx context.Context, logger Logger, fields ...string) context.Context {
+	otzCtx := otzctx.GetOrNewOTZContext(ctx)
+	otzCtx.SetLogger(requestLogger(otzCtx, logger, fields))
+
+	return ctx
+}
+
+// WithSpanCtx 设置请求的span, 并将trace_id及span_id追加到请求的logger
+func WithSpanCtx(ctx context.Context, span trace.Span) context.Context {
+	otzCtx := otzctx.GetOrNewOTZContext(ctx)
+	otzCtx.SetSpan(span)
+	if sc := span.SpanContext(); sc.IsValid() {
+		WithCtx(ctx, FieldTraceID, sc.TraceID().String(), FieldSpanID, sc.SpanID().String())
+	}
+
+	return ctx
+}
+
+// requestLogger 请求的logger, 追加自定义字段及提取器字段, 提取器只在创建时执行一次
+// 命中签名header或规则的请求提升日志等级
+func requestLogger(otzCtx otzctx.Context, logger Logger, fields []string) Logger {
+	fields = append(fields[:len(fields):len(fields)], extractFields(otzCtx)...)
+	if len(fields) > 0 {
+		logger = logger.With(fields...)
+	}
+	if level, ok := escalatedLevel(otzCtx); ok {
+		if l, ok := logger.(LevelLogger); ok {
+			return l.WithLevel(level)
+		}
+	}
+	return logger
+}
+
+// WithLevelCtx 为当前请求设置日志等级, 不影响全局等级
+// logger未实现LevelLogger时不做处理
+func WithLevelCtx(ctx context.Context, level Level) context.Context {
+	otzCtx := otzctx.GetOrNewOTZContext(ctx)
+	logger, ok := otzCtx.GetLogger().(Logger)
+	if !ok || logger == nil {
+		logger = requestLogger(otzCtx, GetDefaultLogger(), nil)
+	}
+	if l, ok := logger.(LevelLogger); ok {
+		otzCtx.SetLogger(l.WithLevel(level))
+	}
+
+	return ctx
+}
+
+// Trace without format
+func Trace(args ...interface{}) {
+	GetDefaultLogger().Trace(makeMsg(args...))
+}
+
+// Tracef with format
+func Tracef(format string, args ...interface{}) {
+	GetDefaultLogger().Trace(makeMsgFormat(format, args...))
+}
+
+// TraceCtx without format
+func TraceCtx(ctx context.Context, args ...interface{}) {
+	ctxLogger(ctx).Trace(args...)
+}
+
+// TraceCtxf with format
+func TraceCtxf(ctx context.Context, format string, args ...interface{}) {
+	ctxLogger(ctx).Tracef(format, args...)
+}
+
 // Debug without format
 func Debug(args ...interface{}) {
 	GetDefaultLogger().Debug(makeMsg(args...))
@@ -125,22 +203,12 @@ func Debugf(format string, args ...interface{}) {
 
 // DebugCtx without format
 func DebugCtx(ctx context.Context, args ...interface{}) {
-	logger, ok := otzctx.OTZContext(ctx).GetLogger().(Logger)
-	if ok && logger != nil {
-		logger.Debug(args...)
-		return
-	}
-	GetDefaultLogger().Debug(args...)
+	ctxLogger(ctx).Debug(args...)
 }
 
 // DebugCtxf with format
 func DebugCtxf(ctx context.Context, format string, args ...interface{}) {
-	logger, ok := otzctx.OTZContext(ctx).GetLogger().(Logger)
-	if ok && logger != nil {
-		logger.Debugf(format, args...)
-		return
-	}
-	GetDefaultLogger().Debugf(format, args...)
+	ctxLogger(ctx).Debugf(format, args...)
 }
 
 // Info without format
@@ -155,22 +223,12 @@ func Infof(format string, args ...interface{}) {
 
 // InfoCtx without format
 func InfoCtx(ctx context.Context, args ...interface{}) {
-	logger, ok := otzctx.OTZContext(ctx).GetLogger().(Logger)
-	if ok && logger != nil {
-		logger.Info(args...)
-		return
-	}
-	GetDefaultLogger().Info(args...)
+	ctxLogger(ctx).Info(args...)
 }
 
 // InfoCtxf with format
 func InfoCtxf(ctx context.Context, format string, args ...interface{}) {
-	logger, ok := otzctx.OTZContext(ctx).GetLogger().(Logger)
-	if ok && logger != nil {
-		logger.Infof(format, args...)
-		return
-	}
-	GetDefaultLogger().Infof(format, args...)
+	ctxLogger(ctx).Infof(format, args...)
 }
 
 // Warn without format
@@ -185,22 +243,12 @@ func Warnf(format string, args ...interface{}) {
 
 // WarnCtxf with format
 func WarnCtxf(ctx context.Context, format string, args ...interface{}) {
-	logger, ok := otzctx.OTZContext(ctx).GetLogger().(Logger)
-	if ok && logger != nil {
-		logger.Warnf(format, args...)
-		return
-	}
-	GetDefaultLogger().Warnf(format, args...)
+	ctxLogger(ctx).Warnf(format, args...)
 }
 
 // WarnCtx without format
 func WarnCtx(ctx context.Context, args ...interface{}) {
-	logger, ok := otzctx.OTZContext(ctx).GetLogger().(Logger)
-	if ok && logger != nil {
-		logger.Warn(args...)
-		return
-	}
-	GetDefaultLogger().Warn(args...)
+	ctxLogger(ctx).Warn(args...)
 }
 
 // Error without format
@@ -215,22 +263,12 @@ func Errorf(format string, args ...interface{}) {
 
 // ErrorCtx without format
 func ErrorCtx(ctx context.Context, args ...interface{}) {
-	logger, ok := otzctx.OTZContext(ctx).GetLogger().(Logger)
-	if ok && logger != nil {
-		logger.Error(args...)
-		return
-	}
-	GetDefaultLogger().Error(args...)
+	ctxLogger(ctx).Error(args...)
 }
 
 // ErrorCtxf with format
 func ErrorCtxf(ctx context.Context, format string, args ...interface{}) {
-	logger, ok := otzctx.OTZContext(ctx).GetLogger().(Logger)
-	if ok && logger != nil {
-		logger.Errorf(format, args...)
-		return
-	}
-	GetDefaultLogger().Errorf(format, args...)
+	ctxLogger(ctx).Errorf(format, args...)
 }
 
 // Fatal without format
@@ -245,20 +283,10 @@ func Fatalf(format string, args ...interface{}) {
 
 // FatalCtx with format
 func FatalCtx(ctx context.Context, args ...interface{}) {
-	logger, ok := otzctx.OTZContext(ctx).GetLogger().(Logger)
-	if ok && logger != nil {
-		logger.Fatal(args...)
-		return
-	}
-	GetDefaultLogger().Fatal(args...)
+	ctxLogger(ctx).Fatal(args...)
 }
 
 // FatalCtxf with format
 func FatalCtxf(ctx context.Context, format string, args ...interface{}) {
-	logger, ok := otzctx.OTZContext(ctx).GetLogger().(Logger)
-	if ok && logger != nil {
-		logger.Fatalf(format, args...)
-		return
-	}
-	GetDefaultLogger().Fatalf(format, args...)
+	ctxLogger(ctx).Fatalf(format, args...)
 }
@@ -6,6 +6,9 @@ import (
 	"github.com/ShadowsGtt/otz/log"
 	"github.com/ShadowsGtt/otz/otzctx"
 	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -81,7 +84,7 @@ func TestSetDefaultWithLoader(t *testing.T) {
 log:
   - output_type: file # 日志输出 console/file
     file_name: ./loader_test.log   # 文件名
-    level: debug # 日志级别 debug info warn error fatal
+    level: debug # 日志级别 trace debug info warn error fatal
     max_size: 10   # 文件大小限制 MB
     max_age: 7    # 保留天数
     max_backups: 10 # 文件数
@@ -116,3 +119,37 @@ log:
 	log.WithCtx(ctx, "age", "18")
 	log.InfoCtxf(ctx, "this test for parser")
 }
+
+func TestTraceLevel(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "trace.log")
+	logger := log.NewZapLog(log.Config{
+		OutputType: log.OutputTypeFile,
+		FileName:   fileName,
+		Level:      "info",
+		FormatType: log.FormatTypeText,
+	})
+	logger.Trace("global trace")
+	logger.Debug("global debug")
+
+	// 请求级开启trace, 不影响原logger
+	ctx := otzctx.NewOtzContext(context.Background()).Context()
+	otzctx.OTZContext(ctx).SetLogger(logger)
+	log.WithLevelCtx(ctx, log.LevelTrace)
+	log.TraceCtxf(ctx, "request %s", "trace")
+	logger.Trace("global trace again")
+	if err := logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(content)
+	if strings.Contains(out, "global") {
+		t.Fatalf("global logger should stay at info level, got: %s", out)
+	}
+	if !strings.Contains(out, "TRACE") || !strings.Contains(out, "request trace") {
+		t.Fatalf("request trace log missing, got: %s", out)
+	}
+}
@@ -13,8 +13,38 @@ const (
 	LevelFatal
 )
 
+var levelNames = map[Level]string{
+	LevelNil:   "nil",
+	LevelTrace: "trace",
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+	LevelFatal: "fatal",
+}
+
+// String 日志等级名称
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseLevel 解析日志等级名称
+func ParseLevel(name string) (Level, bool) {
+	for l, n := range levelNames {
+		if l != LevelNil && n == name {
+			return l, true
+		}
+	}
+	return LevelNil, false
+}
+
 // Logger 日志接口
 type Logger interface {
+	Trace(args ...interface{})
+	Tracef(format string, args ...interface{})
 	Debug(args ...interface{})
 	Debugf(format string, args ...interface{})
 	Info(args ...interface{})
@@ -28,3 +58,8 @@ type Logger interface {
 	Flush() error
 	With(fields ...string) Logger
 }
+
+// LevelLogger 支持派生不同等级的logger
+type LevelLogger interface {
+	WithLevel(level Level) Logger
+}
@@ -0,0 +1,284 @@
+// Package logtest 提供内存日志记录器, 便于在单测中断言日志输出
+package logtest
+
+import (
+	"context"
+	"fmt"
+	"github.com/ShadowsGtt/otz/log"
+	"github.com/ShadowsGtt/otz/otzctx"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	logPkgPrefix     = "github.com/ShadowsGtt/otz/log."
+	logtestPkgPrefix = "github.com/ShadowsGtt/otz/log/logtest."
+)
+
+// Entry 一条日志记录
+type Entry struct {
+	Time    time.Time
+	Level   log.Level
+	Message string
+	Fields  map[string]string
+	Caller  string // file:line
+}
+
+// String 日志记录描述
+func (e Entry) String() string {
+	return fmt.Sprintf("[%s] %s %v (%s)", e.Level, e.Message, e.Fields, e.Caller)
+}
+
+// Entries 日志记录集合
+type Entries []Entry
+
+// Len 记录条数
+func (es Entries) Len() int {
+	return len(es)
+}
+
+// Filter 按自定义条件过滤
+func (es Entries) Filter(fn func(Entry) bool) Entries {
+	result := Entries{}
+	for _, e := range es {
+		if fn(e) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// FilterLevel 按日志等级过滤
+func (es Entries) FilterLevel(level log.Level) Entries {
+	return es.Filter(func(e Entry) bool {
+		return e.Level == level
+	})
+}
+
+// FilterMessage 按日志内容过滤(包含子串)
+func (es Entries) FilterMessage(substr string) Entries {
+	return es.Filter(func(e Entry) bool {
+		return strings.Contains(e.Message, substr)
+	})
+}
+
+// FilterField 按自定义字段过滤
+func (es Entries) FilterField(key, value string) Entries {
+	return es.Filter(func(e Entry) bool {
+		v, ok := e.Fields[key]
+		return ok && v == value
+	})
+}
+
+type store struct {
+	mu      sync.Mutex
+	entries Entries
+}
+
+// Recorder 内存日志记录器, 实现log.Logger
+type Recorder struct {
+	store  *store
+	fields []string
+}
+
+// New 创建内存日志记录器
+func New() *Recorder {
+	return &Recorder{store: &store{}}
+}
+
+// Install 将记录器设置为默认日志, 单测结束后恢复原默认日志
+// 修改的是全局默认日志, 不能与t.Parallel同时使用, 并行单测请使用WithCtx
+func Install(t testing.TB) *Recorder {
+	r := New()
+	prev := log.GetDefaultLogger()
+	log.SetDefaultLogger(r)
+	t.Cleanup(func() {
+		log.SetDefaultLogger(prev)
+	})
+	return r
+}
+
+// WithCtx 创建绑定了记录器的ctx, 只记录通过该ctx输出的日志
+func WithCtx(ctx context.Context) (context.Context, *Recorder) {
+	r := New()
+	otzCtx := otzctx.NewOtzContext(ctx)
+	otzCtx.SetLogger(r)
+	return otzCtx.Context(), r
+}
+
+// All 获取所有日志记录
+func (r *Recorder) All() Entries {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	entries := make(Entries, len(r.store.entries))
+	copy(entries, r.store.entries)
+	return entries
+}
+
+// Reset 清空日志记录
+func (r *Recorder) Reset() {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	r.store.entries = nil
+}
+
+// AssertLogged 断言存在指定等级且包含msg的日志, 返回第一条匹配记录
+func (r *Recorder) AssertLogged(t testing.TB, level log.Level, msg string) Entry {
+	t.Helper()
+	matched := r.All().FilterLevel(level).FilterMessage(msg)
+	if matched.Len() == 0 {
+		t.Fatalf("expected %s log containing %q, got:\n%s", level, msg, r.dump())
+		return Entry{}
+	}
+	return matched[0]
+}
+
+// AssertNotLogged 断言不存在指定等级且包含msg的日志
+func (r *Recorder) AssertNotLogged(t testing.TB, level log.Level, msg string) {
+	t.Helper()
+	matched := r.All().FilterLevel(level).FilterMessage(msg)
+	if matched.Len() != 0 {
+		t.Fatalf("unexpected %s log containing %q:\n%s", level, msg, r.dump())
+	}
+}
+
+// AssertCount 断言日志条数
+func (r *Recorder) AssertCount(t testing.TB, n int) {
+	t.Helper()
+	if got := r.All().Len(); got != n {
+		t.Fatalf("expected %d logs, got %d:\n%s", n, got, r.dump())
+	}
+}
+
+func (r *Recorder) dump() string {
+	b := strings.Builder{}
+	for _, e := range r.All() {
+		b.WriteString("  ")
+		b.WriteString(e.String())
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func (r *Recorder) record(level log.Level, msg string) {
+	fields := make(map[string]string, len(r.fields)/2)
+	for i := 0; i+1 < len(r.fields); i += 2 {
+		fields[r.fields[i]] = r.fields[i+1]
+	}
+	e := Entry{
+		Time:    time.Now(),
+		Level:   level,
+		Message: msg,
+		Fields:  fields,
+		Caller:  caller(),
+	}
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	r.store.entries = append(r.store.entries, e)
+}
+
+// caller 跳过log和logtest包内的调用栈, 定位到业务调用方
+func caller() string {
+	pcs := make([]uintptr, 16)
+	n := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, logPkgPrefix) &&
+			!strings.HasPrefix(frame.Function, logtestPkgPrefix) {
+			return fmt.Sprintf("%s:%d", shortPath(frame.File), frame.Line)
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+// shortPath 保留最后一级目录, 与zap ShortCallerEncoder一致
+func shortPath(file string) string {
+	idx := strings.LastIndexByte(file, '/')
+	if idx == -1 {
+		return file
+	}
+	idx = strings.LastIndexByte(file[:idx], '/')
+	if idx == -1 {
+		return file
+	}
+	return file[idx+1:]
+}
+
+// With 设置用户自定义字段
+func (r *Recorder) With(fields ...string) log.Logger {
+	merged := make([]string, 0, len(r.fields)+len(fields))
+	merged = append(merged, r.fields...)
+	merged = append(merged, fields...)
+	return &Recorder{store: r.store, fields: merged}
+}
+
+// Trace without format
+func (r *Recorder) Trace(args ...interface{}) {
+	r.record(log.LevelTrace, fmt.Sprint(args...))
+}
+
+// Tracef with format
+func (r *Recorder) Tracef(format string, args ...interface{}) {
+	r.record(log.LevelTrace, fmt.Sprintf(format, args...))
+}
+
+// Debug without format
+func (r *Recorder) Debug(args ...interface{}) {
+	r.record(log.LevelDebug, fmt.Sprint(args...))
+}
+
+// Debugf with format
+func (r *Recorder) Debugf(format string, args ...interface{}) {
+	r.record(log.LevelDebug, fmt.Sprintf(format, args...))
+}
+
+// Info without format
+func (r *Recorder) Info(args ...interface{}) {
+	r.record(log.LevelInfo, fmt.Sprint(args...))
+}
+
+// Infof with format
+func (r *Recorder) Infof(format string, args ...interface{}) {
+	r.record(log.LevelInfo, fmt.Sprintf(format, args...))
+}
+
+// Warn without format
+func (r *Recorder) Warn(args ...interface{}) {
+	r.record(log.LevelWarn, fmt.Sprint(args...))
+}
+
+// Warnf with format
+func (r *Recorder) Warnf(format string, args ...interface{}) {
+	r.record(log.LevelWarn, fmt.Sprintf(format, args...))
+}
+
+// Error without format
+func (r *Recorder) Error(args ...interface{}) {
+	r.record(log.LevelError, fmt.Sprint(args...))
+}
+
+// Errorf with format
+func (r *Recorder) Errorf(format string, args ...interface{}) {
+	r.record(log.LevelError, fmt.Sprintf(format, args...))
+}
+
+// Fatal 只记录, 不退出进程
+func (r *Recorder) Fatal(args ...interface{}) {
+	r.record(log.LevelFatal, fmt.Sprint(args...))
+}
+
+// Fatalf 只记录, 不退出进程
+func (r *Recorder) Fatalf(format string, args ...interface{}) {
+	r.record(log.LevelFatal, fmt.Sprintf(format, args...))
+}
+
+// Flush 无需刷新
+func (r *Recorder) Flush() error {
+	return nil
+}
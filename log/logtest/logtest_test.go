@@ -0,0 +1,53 @@
+package logtest_test
+
+import (
+	"context"
+	"github.com/ShadowsGtt/otz/log"
+	"github.com/ShadowsGtt/otz/log/logtest"
+	"strings"
+	"testing"
+)
+
+func TestInstall(t *testing.T) {
+	r := logtest.Install(t)
+
+	log.Infof("hello %s", "otz")
+	log.Debug("debug msg")
+	log.With("name", "tom").Warnf("with fields")
+
+	r.AssertCount(t, 3)
+	e := r.AssertLogged(t, log.LevelInfo, "hello otz")
+	if !strings.HasPrefix(e.Caller, "logtest/logtest_test.go:") {
+		t.Fatalf("unexpected caller: %s", e.Caller)
+	}
+	r.AssertLogged(t, log.LevelDebug, "debug msg")
+	r.AssertNotLogged(t, log.LevelError, "hello")
+
+	if n := r.All().FilterField("name", "tom").Len(); n != 1 {
+		t.Fatalf("expected 1 entry with field name=tom, got %d", n)
+	}
+
+	r.Reset()
+	r.AssertCount(t, 0)
+}
+
+func TestWithCtx(t *testing.T) {
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			ctx, r := logtest.WithCtx(context.Background())
+			log.WithCtx(ctx, "case", name)
+
+			log.InfoCtxf(ctx, "case %s", name)
+			log.ErrorCtx(ctx, "failed")
+
+			r.AssertCount(t, 2)
+			r.AssertLogged(t, log.LevelInfo, "case "+name)
+			e := r.AssertLogged(t, log.LevelError, "failed")
+			if e.Fields["case"] != name {
+				t.Fatalf("unexpected fields: %v", e.Fields)
+			}
+		})
+	}
+}
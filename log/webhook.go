@@ -0,0 +1,203 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// WebhookHookName SetupWebhook注册的hook名
+	WebhookHookName = "webhook"
+
+	defaultWebhookInterval  = 10 * time.Second
+	defaultWebhookTimeout   = 5 * time.Second
+	defaultWebhookMaxAlerts = 50
+)
+
+// WebhookConfig webhook告警配置
+type WebhookConfig struct {
+	URL         string            `yaml:"url"`          // 告警地址, 为空不开启
+	Level       string            `yaml:"level"`        // 触发等级, 默认error
+	Interval    time.Duration     `yaml:"interval"`     // 聚合发送间隔, 默认10s
+	Timeout     time.Duration     `yaml:"timeout"`      // 请求超时, 默认5s
+	MaxAlerts   int               `yaml:"max_alerts"`   // 单次最多发送告警条数, 默认50
+	DedupWindow time.Duration     `yaml:"dedup_window"` // 去重窗口, 窗口内重复的日志在下次触发时合并计数, 为0不去重
+	RateLimit   int               `yaml:"rate_limit"`   // 每秒最多接收告警条数, 为0不限制
+	Headers     map[string]string `yaml:"headers"`      // 自定义请求头
+}
+
+// Alert 聚合后的告警
+type Alert struct {
+	Level     string            `json:"level"`
+	Message   string            `json:"message"`
+	Caller    string            `json:"caller"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	Count     int               `json:"count"`
+	FirstTime time.Time         `json:"first_time"`
+	LastTime  time.Time         `json:"last_time"`
+}
+
+// WebhookPayload webhook请求体
+type WebhookPayload struct {
+	Total  int      `json:"total"`  // 本次聚合的日志总条数
+	Alerts []*Alert `json:"alerts"` // 按条数降序
+}
+
+// WebhookHook 按间隔聚合日志, 并以json POST到指定地址
+type WebhookHook struct {
+	cfg    WebhookConfig
+	client *http.Client
+
+	mutex  sync.Mutex
+	alerts map[string]*Alert
+	total  int
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+// NewWebhookHook 创建webhook hook, 并启动定时发送
+func NewWebhookHook(cfg WebhookConfig) *WebhookHook {
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultWebhookInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultWebhookTimeout
+	}
+	if cfg.MaxAlerts <= 0 {
+		cfg.MaxAlerts = defaultWebhookMaxAlerts
+	}
+	h := &WebhookHook{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		alerts: map[string]*Alert{},
+		stop:   make(chan struct{}),
+	}
+	go h.loop()
+	return h
+}
+
+// SetupWebhook 按配置注册webhook告警, 替换已注册的webhook
+func SetupWebhook(cfg WebhookConfig) (*WebhookHook, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("webhook url is empty")
+	}
+	level := LevelError
+	if cfg.Level != "" {
+		var ok bool
+		if level, ok = ParseLevel(cfg.Level); !ok {
+			return nil, fmt.Errorf("invalid webhook level: %s", cfg.Level)
+		}
+	}
+	h := NewWebhookHook(cfg)
+	AddHook(WebhookHookName, h, HookOptions{
+		Level:       level,
+		DedupWindow: cfg.DedupWindow,
+		RateLimit:   cfg.RateLimit,
+	})
+	return h, nil
+}
+
+// Fire 聚合日志, 等待定时发送
+func (h *WebhookHook) Fire(e Entry) error {
+	key := fmt.Sprintf("%d|%s|%s", e.Level, e.Message, e.Caller)
+	count := 1 + e.Repeated
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.total += count
+	if a, ok := h.alerts[key]; ok {
+		a.Count += count
+		a.LastTime = e.Time
+		return nil
+	}
+	h.alerts[key] = &Alert{
+		Level:     e.Level.String(),
+		Message:   e.Message,
+		Caller:    e.Caller,
+		Fields:    e.Fields,
+		Count:     count,
+		FirstTime: e.Time,
+		LastTime:  e.Time,
+	}
+	return nil
+}
+
+// Flush 立即发送已聚合的告警
+func (h *WebhookHook) Flush() error {
+	h.mutex.Lock()
+	if len(h.alerts) == 0 {
+		h.mutex.Unlock()
+		return nil
+	}
+	payload := &WebhookPayload{Total: h.total}
+	for _, a := range h.alerts {
+		payload.Alerts = append(payload.Alerts, a)
+	}
+	h.alerts = map[string]*Alert{}
+	h.total = 0
+	h.mutex.Unlock()
+
+	sort.Slice(payload.Alerts, func(i, j int) bool {
+		return payload.Alerts[i].Count > payload.Alerts[j].Count
+	})
+	if len(payload.Alerts) > h.cfg.MaxAlerts {
+		payload.Alerts = payload.Alerts[:h.cfg.MaxAlerts]
+	}
+	return h.post(payload)
+}
+
+// Close 停止定时发送, 并发送剩余告警
+func (h *WebhookHook) Close() error {
+	h.stopOnce.Do(func() {
+		close(h.stop)
+	})
+	return h.Flush()
+}
+
+func (h *WebhookHook) loop() {
+	ticker := time.NewTicker(h.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := h.Flush(); err != nil {
+				// 不能使用日志输出, 避免错误日志再次触发hook
+				fmt.Fprintf(os.Stderr, "log webhook flush failed, err: %v\n", err)
+			}
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+func (h *WebhookHook) post(payload *WebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, h.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range h.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	rsp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("webhook response status: %d", rsp.StatusCode)
+	}
+	return nil
+}
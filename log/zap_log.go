@@ -29,7 +29,7 @@ const (
 type Config struct {
 	OutputType OutputType `yaml:"output_type"` // 输出位置 console/file
 	FileName   string     `yaml:"file_name"`   // 文件名
-	Level      string     `yaml:"level"`       // 日志等级 debug info warn error fatal
+	Level      string     `yaml:"level"`       // 日志等级 trace debug info warn error fatal
 	MaxSize    int        `yaml:"max_size"`    // 文件大小限制 MB
 	MaxAge     int        `yaml:"max_age"`     // 保留天数
 	MaxBackups int        `yaml:"max_backups"` // 文件数
@@ -38,9 +38,13 @@ type Config struct {
 	Skip       int        `yaml:"skip"`        // 跳过的调用栈
 }
 
+// TraceLevel 自定义trace等级, 低于debug
+const TraceLevel = zapcore.DebugLevel - 1
+
 // Levels 配置日志等级 -> zapcore.Level
 var Levels = map[string]zapcore.Level{
 	"":      zapcore.DebugLevel,
+	"trace": TraceLevel,
 	"debug": zapcore.DebugLevel,
 	"info":  zapcore.InfoLevel,
 	"warn":  zapcore.WarnLevel,
@@ -48,56 +52,113 @@ var Levels = map[string]zapcore.Level{
 	"fatal": zapcore.FatalLevel,
 }
 
+// zapLevels Level -> zapcore.Level
+var zapLevels = map[Level]zapcore.Level{
+	LevelTrace: TraceLevel,
+	LevelDebug: zapcore.DebugLevel,
+	LevelInfo:  zapcore.InfoLevel,
+	LevelWarn:  zapcore.WarnLevel,
+	LevelError: zapcore.ErrorLevel,
+	LevelFatal: zapcore.FatalLevel,
+}
+
 // ZapLog zap日志
 type ZapLog struct {
 	zapLog *zap.Logger
 	cfgs   []Config
+	cores  []zapcore.Core // 不做等级过滤的原始core, 与cfgs一一对应
+	skip   int
+	fields []zap.Field
+	level  *zapcore.Level // 请求级等级覆盖, 为空时使用配置等级
 }
 
 // NewZapLog 创建zap日志
 func NewZapLog(cfgs ...Config) Logger {
-	cores := []zapcore.Core{}
 	skip := 2
 	for _, c := range cfgs {
 		if c.Skip != 0 {
 			skip = c.Skip
 		}
-		cores = append(cores, createZapCore(c))
-	}
-	return &ZapLog{
-		zapLog: zap.New(
-			zapcore.NewTee(cores...),
-			zap.AddCaller(),
-			zap.AddCallerSkip(skip),
-		),
-		cfgs: cfgs,
 	}
+	return newZapLog(skip, cfgs...)
 }
 
 // NewZapLogWithSkip 创建zap日志
 func NewZapLogWithSkip(skip int, cfgs ...Config) Logger {
-	cores := []zapcore.Core{}
+	return newZapLog(skip, cfgs...)
+}
+
+func newZapLog(skip int, cfgs ...Config) *ZapLog {
+	cores := make([]zapcore.Core, 0, len(cfgs))
 	for _, c := range cfgs {
 		cores = append(cores, createZapCore(c))
 	}
-	return &ZapLog{
-		zapLog: zap.New(
-			zapcore.NewTee(cores...),
-			zap.AddCaller(),
-			zap.AddCallerSkip(skip),
-		),
-		cfgs: cfgs,
+	zl := &ZapLog{
+		cfgs:  cfgs,
+		cores: cores,
+		skip:  skip,
 	}
+	zl.build()
+	return zl
+}
+
+// build 按配置等级及等级覆盖重新组装zap logger
+func (zl *ZapLog) build() {
+	cores := make([]zapcore.Core, 0, len(zl.cores))
+	for i, c := range zl.cores {
+		level := Levels[zl.cfgs[i].Level]
+		if zl.level != nil && *zl.level < level {
+			level = *zl.level
+		}
+		cores = append(cores, &levelCore{Core: c, level: level})
+	}
+	cores = append(cores, &hookCore{})
+	zl.zapLog = zap.New(
+		zapcore.NewTee(cores...),
+		zap.AddCaller(),
+		zap.AddCallerSkip(zl.skip),
+	).With(zl.fields...)
 }
 
 func createZapCore(c Config) zapcore.Core {
 	wr := getOutputWriter(c)
 	ws := zapcore.AddSync(wr)
 	encoder := newEncoder(c)
-	level := zap.NewAtomicLevelAt(Levels[c.Level])
-	core := zapcore.NewCore(encoder, ws, level)
+	// 等级过滤由levelCore负责, 便于按请求调整等级
+	return zapcore.NewCore(encoder, ws, TraceLevel)
+}
+
+// levelCore 按等级过滤日志
+type levelCore struct {
+	zapcore.Core
+	level zapcore.Level
+}
+
+// Enabled 是否输出该等级
+func (c *levelCore) Enabled(l zapcore.Level) bool {
+	return c.level.Enabled(l)
+}
 
-	return core
+// With 设置自定义字段
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelCore{Core: c.Core.With(fields), level: c.level}
+}
+
+// Check 检查是否输出
+func (c *levelCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.Enabled(ent.Level) {
+		return ce
+	}
+	return c.Core.Check(ent, ce)
+}
+
+// encodeLevel 支持自定义的trace等级
+func encodeLevel(l zapcore.Level, enc zapcore.PrimitiveArrayEncoder) {
+	if l == TraceLevel {
+		enc.AppendString("TRACE")
+		return
+	}
+	zapcore.CapitalLevelEncoder(l, enc)
 }
 
 func newEncoder(c Config) zapcore.Encoder {
@@ -110,7 +171,7 @@ func newEncoder(c Config) zapcore.Encoder {
 		MessageKey:     "msg",
 		StacktraceKey:  "stacktrace",
 		LineEnding:     zapcore.DefaultLineEnding,
-		EncodeLevel:    zapcore.CapitalLevelEncoder,
+		EncodeLevel:    encodeLevel,
 		EncodeTime:     zapcore.TimeEncoderOfLayout("2006-01-02 15:04:05.999"),
 		EncodeDuration: zapcore.StringDurationEncoder,
 		EncodeCaller:   zapcore.ShortCallerEncoder,
@@ -153,9 +214,47 @@ func (zl *ZapLog) With(fields ...string) Logger {
 	for i := range zapFields {
 		zapFields[i] = zap.Any(fields[2*i], fields[2*i+1])
 	}
+	merged := make([]zap.Field, 0, len(zl.fields)+len(zapFields))
+	merged = append(merged, zl.fields...)
+	merged = append(merged, zapFields...)
 	return &ZapLog{
 		zapLog: zl.zapLog.With(zapFields...),
 		cfgs:   zl.cfgs,
+		cores:  zl.cores,
+		skip:   zl.skip,
+		fields: merged,
+		level:  zl.level,
+	}
+}
+
+// WithLevel 派生指定等级的logger, 只会降低配置的等级, 不影响原logger
+func (zl *ZapLog) WithLevel(level Level) Logger {
+	zapLevel, ok := zapLevels[level]
+	if !ok {
+		return zl
+	}
+	l := &ZapLog{
+		cfgs:   zl.cfgs,
+		cores:  zl.cores,
+		skip:   zl.skip,
+		fields: zl.fields,
+		level:  &zapLevel,
+	}
+	l.build()
+	return l
+}
+
+// Trace without format
+func (zl *ZapLog) Trace(args ...interface{}) {
+	if ce := zl.zapLog.Check(TraceLevel, makeMsg(args...)); ce != nil {
+		ce.Write()
+	}
+}
+
+// Tracef with format
+func (zl *ZapLog) Tracef(format string, args ...interface{}) {
+	if ce := zl.zapLog.Check(TraceLevel, makeMsgFormat(format, args...)); ce != nil {
+		ce.Write()
 	}
 }
 
@@ -0,0 +1,70 @@
+package otz
+
+import (
+	"github.com/ShadowsGtt/otz/errs"
+	"github.com/ShadowsGtt/otz/log"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+const (
+	codeInvalidParam = 400
+	codeNotFound     = 404
+)
+
+// levelRuleReq 添加日志等级提升规则请求
+type levelRuleReq struct {
+	log.LevelRule
+	TTL int64 `json:"ttl"` // 有效期(秒), 未设置expire_at时使用
+}
+
+// RegisterLogRuleAdmin 在管理端口上注册日志等级提升规则管理接口, 使用server.admin配置的token及IP白名单校验
+// GET path: 查询规则; POST path: 添加规则; DELETE path/:id: 删除规则
+// 未配置server.admin.address时Start返回错误
+func (s *Server) RegisterLogRuleAdmin(path string) {
+	s.Admin().registerLogRuleAdmin(path)
+}
+
+// registerLogRuleAdmin 在服务上注册日志等级提升规则管理接口
+func (svc *Service) registerLogRuleAdmin(path string) {
+	svc.engine.GET(path, func(ginCtx *gin.Context) {
+		writeAdminRsp(ginCtx, log.LevelRules(), nil)
+	})
+	svc.engine.POST(path, func(ginCtx *gin.Context) {
+		req := &levelRuleReq{}
+		if err := ginCtx.ShouldBindJSON(req); err != nil {
+			writeAdminRsp(ginCtx, nil, errs.New(codeInvalidParam, err.Error()))
+			return
+		}
+		rule := req.LevelRule
+		if rule.ExpireAt.IsZero() && req.TTL > 0 {
+			rule.ExpireAt = time.Now().Add(time.Duration(req.TTL) * time.Second)
+		}
+		id, err := log.AddLevelRule(rule)
+		if err != nil {
+			writeAdminRsp(ginCtx, nil, errs.New(codeInvalidParam, err.Error()))
+			return
+		}
+		svc.server.infof("add log level rule, id: %s, user_id: %s, path: %s, level: %s, expire_at: %s",
+			id, rule.UserID, rule.Path, rule.Level, rule.ExpireAt.Format(time.RFC3339))
+		writeAdminRsp(ginCtx, gin.H{"id": id}, nil)
+	})
+	svc.engine.DELETE(path+"/:id", func(ginCtx *gin.Context) {
+		id := ginCtx.Param("id")
+		if !log.RemoveLevelRule(id) {
+			writeAdminRsp(ginCtx, nil, errs.Newf(codeNotFound, "rule %s not found", id))
+			return
+		}
+		svc.server.infof("remove log level rule, id: %s", id)
+		writeAdminRsp(ginCtx, nil, nil)
+	})
+}
+
+func writeAdminRsp(ginCtx *gin.Context, data interface{}, err error) {
+	ginCtx.JSON(http.StatusOK, gin.H{
+		"code": errs.Code(err),
+		"msg":  errs.Msg(err),
+		"data": data,
+	})
+}
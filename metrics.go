@@ -0,0 +1,205 @@
+package otz
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	metricsPath = "/metrics"
+
+	// ginErrCodeKey 请求的errs错误码, 由Register等写入gin.Context供指标使用
+	ginErrCodeKey = "otz_err_code"
+	// unmatchedRoute 未匹配路由的请求使用的route标签, 避免按原始路径产生大量时间序列
+	unmatchedRoute = "unmatched"
+	// otherMethod 非标准http方法使用的method标签
+	otherMethod = "other"
+)
+
+// MetricsConfig 指标配置, 指标通过管理端口的 /metrics 以Prometheus文本格式暴露
+type MetricsConfig struct {
+	// Disable 不记录请求指标, 自定义指标及运行时指标不受影响
+	Disable bool `yaml:"disable"`
+}
+
+// metricsRegistry 框架及自定义指标的注册表, 同一进程中的多个Server共用
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "otz_requests_total",
+		Help: "Total number of requests by route, status and errs code.",
+	}, []string{"service", "protocol", "method", "route", "status", "code"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "otz_request_duration_seconds",
+		Help:    "Request latency in seconds.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"service", "protocol", "method", "route"})
+	requestsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "otz_requests_in_flight",
+		Help: "Number of requests being served.",
+	}, []string{"service", "protocol"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestsTotal, requestDuration, requestsInFlight,
+	)
+}
+
+// MetricsHandler Prometheus文本格式的指标接口, 管理端口未开启时可以自行注册到其他服务
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// RegisterCollector 注册自定义的prometheus.Collector
+func RegisterCollector(c prometheus.Collector) error {
+	return metricsRegistry.Register(c)
+}
+
+// register 注册指标, 同名同标签的指标已存在时返回已注册的指标, 可以重复调用
+func register[T prometheus.Collector](c T) T {
+	if err := metricsRegistry.Register(c); err != nil {
+		var registered prometheus.AlreadyRegisteredError
+		if errors.As(err, &registered) {
+			if existing, ok := registered.ExistingCollector.(T); ok {
+				return existing
+			}
+		}
+		panic(err)
+	}
+	return c
+}
+
+// Counter 只增不减的计数器
+type Counter struct {
+	vec *prometheus.CounterVec
+}
+
+// NewCounter 创建计数器, labels为标签名, 同名计数器已存在时复用, 名称或标签冲突时panic
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{vec: register(prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels))}
+}
+
+// Inc 加1, labelValues与创建时的标签一一对应
+func (c *Counter) Inc(labelValues ...string) {
+	c.vec.WithLabelValues(labelValues...).Inc()
+}
+
+// Add 增加v, v不能为负数
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.vec.WithLabelValues(labelValues...).Add(v)
+}
+
+// Gauge 可增可减的瞬时值
+type Gauge struct {
+	vec *prometheus.GaugeVec
+}
+
+// NewGauge 创建瞬时值指标, 同名指标已存在时复用
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{vec: register(prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels))}
+}
+
+// Set 设置为v
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.vec.WithLabelValues(labelValues...).Set(v)
+}
+
+// Add 增加v, v可以为负数
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.vec.WithLabelValues(labelValues...).Add(v)
+}
+
+// Inc 加1
+func (g *Gauge) Inc(labelValues ...string) {
+	g.vec.WithLabelValues(labelValues...).Inc()
+}
+
+// Dec 减1
+func (g *Gauge) Dec(labelValues ...string) {
+	g.vec.WithLabelValues(labelValues...).Dec()
+}
+
+// Histogram 分布统计, 如耗时及大小
+type Histogram struct {
+	vec *prometheus.HistogramVec
+}
+
+// NewHistogram 创建分布统计指标, buckets为空时使用默认的耗时分桶(秒), 同名指标已存在时复用
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if len(buckets) == 0 {
+		buckets = prometheus.DefBuckets
+	}
+	opts := prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}
+	return &Histogram{vec: register(prometheus.NewHistogramVec(opts, labels))}
+}
+
+// Observe 记录一个值
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.vec.WithLabelValues(labelValues...).Observe(v)
+}
+
+// ObserveSince 记录从begin开始的耗时(秒)
+func (h *Histogram) ObserveSince(begin time.Time, labelValues ...string) {
+	h.vec.WithLabelValues(labelValues...).Observe(time.Since(begin).Seconds())
+}
+
+// requestMetrics 一个请求的指标记录
+type requestMetrics struct {
+	service  string
+	protocol string
+	method   string
+	begin    time.Time
+}
+
+// beginRequest 开始记录请求, 请求结束时调用end
+func beginRequest(service, protocol, method string) *requestMetrics {
+	requestsInFlight.WithLabelValues(service, protocol).Inc()
+	return &requestMetrics{service: service, protocol: protocol, method: method, begin: time.Now()}
+}
+
+// end 记录请求数, 耗时及errs错误码
+func (m *requestMetrics) end(route, status string, code int) {
+	requestsInFlight.WithLabelValues(m.service, m.protocol).Dec()
+	requestsTotal.WithLabelValues(m.service, m.protocol, m.method, route, status, strconv.Itoa(code)).Inc()
+	requestDuration.WithLabelValues(m.service, m.protocol, m.method, route).Observe(time.Since(m.begin).Seconds())
+}
+
+// metricsEnabled 服务是否记录请求指标, 按所属Server的配置判断, 管理端口不记录
+func (svc *Service) metricsEnabled() bool {
+	return svc.server != nil && !svc.server.cfg.Server.Metrics.Disable && svc.cfg.Name != adminServiceName
+}
+
+// metricsMethod http方法的method标签, 客户端可以发送任意方法, 非标准方法统一为other
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return otherMethod
+}
+
+// metricsMiddleware 记录http请求指标, route使用注册的路由模板
+func metricsMiddleware(service string) gin.HandlerFunc {
+	return func(ginCtx *gin.Context) {
+		m := beginRequest(service, "http", metricsMethod(ginCtx.Request.Method))
+		defer func() {
+			route := ginCtx.FullPath()
+			if route == "" {
+				route = unmatchedRoute
+			}
+			m.end(route, strconv.Itoa(ginCtx.Writer.Status()), ginCtx.GetInt(ginErrCodeKey))
+		}()
+		ginCtx.Next()
+	}
+}
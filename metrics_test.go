@@ -0,0 +1,106 @@
+package otz
+
+import (
+	"context"
+	"fmt"
+	"github.com/ShadowsGtt/otz/errs"
+	"github.com/ShadowsGtt/otz/log/logtest"
+	"github.com/ShadowsGtt/otz/otzctx"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	// 指标注册表全局共用, 使用不同的服务名称使重复执行时计数独立
+	name := fmt.Sprintf("metrics_test_%d", time.Now().UnixNano())
+	cfg, err := ParseConfig("otz_go.yaml", []byte(`server:
+  ip: 127.0.0.1
+  port: 8080
+  services:
+    - name: `+name+`
+      address: 127.0.0.1:8080
+  admin:
+    address: 127.0.0.1:0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(WithConfig(cfg), WithLogger(logtest.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs := NewCounter("test_jobs_total", "Jobs processed.", "service")
+	// 重复创建时复用已注册的指标
+	NewCounter("test_jobs_total", "Jobs processed.", "service").Inc(name)
+	s.Register("/items/:id", func(ctx context.Context) {
+		otzCtx := otzctx.OTZContext(ctx)
+		if otzCtx.GetGinCtx().Param("id") == "0" {
+			otzCtx.SetError(errs.New(404, "item not found"))
+			otzCtx.GetGinCtx().String(http.StatusOK, "not found")
+			return
+		}
+		jobs.Inc(name)
+		otzCtx.GetGinCtx().String(http.StatusOK, "ok")
+	})
+	for _, path := range []string{"/items/1", "/items/2", "/items/0", "/nosuch", "/nosuch2"} {
+		s.services[0].engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	// 非标准方法不产生新的method标签
+	for _, method := range []string{"FOO", "BAR"} {
+		s.services[0].engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/items/1", nil))
+	}
+
+	w := httptest.NewRecorder()
+	s.Admin().engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := w.Body.String()
+	for _, line := range []string{
+		`otz_requests_total{code="0",method="GET",protocol="http",route="/items/:id",service="` + name + `",status="200"} 2`,
+		`otz_requests_total{code="404",method="GET",protocol="http",route="/items/:id",service="` + name + `",status="200"} 1`,
+		`otz_requests_total{code="0",method="GET",protocol="http",route="unmatched",service="` + name + `",status="404"} 2`,
+		`otz_requests_total{code="0",method="other",protocol="http",route="unmatched",service="` + name + `",status="404"} 2`,
+		`otz_request_duration_seconds_count{method="GET",protocol="http",route="/items/:id",service="` + name + `"} 3`,
+		`otz_requests_in_flight{protocol="http",service="` + name + `"} 0`,
+		`test_jobs_total{service="` + name + `"} 3`,
+		`go_goroutines `,
+	} {
+		if !strings.Contains(body, line) {
+			t.Fatalf("metrics should contain %s, got:\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, `method="FOO"`) || strings.Contains(body, `route="/nosuch`) {
+		t.Fatalf("raw method and path should not be used as labels, got:\n%s", body)
+	}
+	if strings.Contains(body, `service="otz_admin"`) {
+		t.Fatal("admin requests should not be recorded")
+	}
+}
+
+func TestMetricsDisabledPerServer(t *testing.T) {
+	newServer := func(disable bool) *Server {
+		cfg, err := ParseConfig("otz_go.yaml", []byte(fmt.Sprintf(`server:
+  services:
+    - name: rpc
+      type: grpc
+      address: 127.0.0.1:0
+  metrics:
+    disable: %t
+`, disable)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := New(WithConfig(cfg), WithLogger(logtest.New()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	disabled := newServer(true)
+	// 后创建的Server不影响之前的Server
+	enabled := newServer(false)
+	if disabled.services[0].metricsEnabled() || !enabled.services[0].metricsEnabled() {
+		t.Fatal("metrics should follow the config of the owning server")
+	}
+}
@@ -0,0 +1,100 @@
+package otz
+
+import (
+	"github.com/ShadowsGtt/otz/log"
+	"github.com/gin-gonic/gin"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"net"
+)
+
+// Option 创建服务的选项
+type Option func(*options)
+
+type options struct {
+	configURIs []string
+	providers  []ConfigProvider
+	config     *Config
+	logger     log.Logger
+	ginMode    string
+	global     bool
+	listeners  map[string]net.Listener
+	// spanExporter 同步导出span, 用于测试
+	spanExporter sdktrace.SpanExporter
+}
+
+// WithConfigFile 配置文件或url, 多个按顺序合并, 默认 ./otz_go.yaml
+func WithConfigFile(uris ...string) Option {
+	return func(o *options) {
+		o.configURIs = append(o.configURIs, uris...)
+	}
+}
+
+// WithConfigProvider 配置来源, 在WithConfigFile之后合并
+func WithConfigProvider(providers ...ConfigProvider) Option {
+	return func(o *options) {
+		o.providers = append(o.providers, providers...)
+	}
+}
+
+// WithConfig 直接使用内存中的配置, 不再加载配置文件, 也不会热加载
+func WithConfig(cfg *Config) Option {
+	return func(o *options) {
+		o.config = cfg
+	}
+}
+
+// WithLogger 服务及其请求使用指定的日志, 忽略配置中的log, WithGlobal时同时设置为默认日志
+func WithLogger(logger log.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithGlobal 将服务设置为进程的全局服务, 一个进程只应有一个, NewServer创建的服务为全局服务
+// 全局服务的配置设置为全局配置(GetGlobalConfig, ConfigSection, Subscribe), 跟随ReloadConfig热加载,
+// 日志配置应用到默认日志, log_escalation, log_fields, log_webhook只对全局服务生效, 并设置gin的运行模式
+func WithGlobal() Option {
+	return func(o *options) {
+		o.global = true
+	}
+}
+
+// WithGinMode gin运行模式, gin的模式为进程级设置, 全局服务默认 gin.ReleaseMode, 其他服务只在指定时设置
+func WithGinMode(mode string) Option {
+	return func(o *options) {
+		o.ginMode = mode
+	}
+}
+
+// WithListener 默认服务使用已创建的listener, 忽略配置中的地址, 便于单测使用随机端口
+func WithListener(listener net.Listener) Option {
+	return WithServiceListener("", listener)
+}
+
+// WithServiceListener 指定服务使用已创建的listener, name为空表示默认服务
+func WithServiceListener(name string, listener net.Listener) Option {
+	return func(o *options) {
+		o.listeners[name] = listener
+	}
+}
+
+// WithSpanExporter 开启链路追踪并同步导出到exporter, 忽略tracing配置中的exporter, 测试中配合NewMemoryExporter使用
+func WithSpanExporter(exporter sdktrace.SpanExporter) Option {
+	return func(o *options) {
+		o.spanExporter = exporter
+	}
+}
+
+func newOptions(opts ...Option) *options {
+	o := &options{listeners: map[string]net.Listener{}}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.global && o.ginMode == "" {
+		o.ginMode = gin.ReleaseMode
+	}
+	if o.config == nil && len(o.configURIs) == 0 && len(o.providers) == 0 {
+		o.configURIs = []string{defaultConfigFile}
+	}
+	return o
+}
@@ -2,103 +2,427 @@ package otz
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/ShadowsGtt/otz/log"
-	"github.com/ShadowsGtt/otz/otzctx"
 	"github.com/gin-gonic/gin"
-	"gopkg.in/yaml.v3"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 	"io/ioutil"
-	"net/http"
-	"runtime/debug"
-	"time"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
-// Server 服务信息
+// Server 服务信息, 包含一个或多个服务, 一起启动和停止
 type Server struct {
-	engine *gin.Engine
+	opts        *options
+	cfg         *Config
+	current     atomic.Value // *Config, 当前生效的配置, 配置热加载后更新, 请求级的配置从这里读取
+	logger      atomic.Value // loggerHolder, 服务的日志, 请求的日志基于该日志
+	providers   []ConfigProvider
+	services    []*Service
+	unknown     map[string]*Service
+	stopWatch   func()
+	stopSignal  func()
+	unsubscribe func()
+	restarting  bool
+	reloadMutex sync.Mutex
+	health      health
+	// tracer 开启链路追踪时不为nil
+	tracer         trace.Tracer
+	tracerProvider *sdktrace.TracerProvider
+	mutex          sync.Mutex
 }
 
-// Register 注册服务
+// Register 在默认服务上注册接口, 默认服务为配置中的第一个服务
 func (s *Server) Register(method string, handler func(ctx context.Context)) {
-	h := func(ginCtx *gin.Context) {
-		otzCtx := otzctx.GetOrNewOTZContext(context.Background())
-		defer otzctx.PutOTZCtx(otzCtx)
-		otzCtx.SetGinCtx(ginCtx)
-		begin := time.Now()
-		defer func() {
-			if err := recover(); err != nil {
-				log.ErrorCtxf(otzCtx.Context(), "%s", string(debug.Stack()))
-				ginCtx.Data(http.StatusInternalServerError, "", nil)
-			}
-			log.InfoCtxf(otzCtx.Context(), "URI: %s, cost: %dms",
-				ginCtx.Request.URL.Path, time.Since(begin).Milliseconds(),
-			)
-		}()
-		handler(otzCtx.Context())
+	s.services[0].Register(method, handler)
+}
+
+// Use 为默认服务追加拦截器
+func (s *Server) Use(interceptors ...Interceptor) {
+	s.services[0].Use(interceptors...)
+}
+
+// Service 按名称获取服务, 服务未配置时返回的服务可以注册接口, 但Start会返回错误
+func (s *Server) Service(name string) *Service {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, svc := range s.services {
+		if svc.cfg.Name == name {
+			return svc
+		}
+	}
+	if svc, ok := s.unknown[name]; ok {
+		return svc
+	}
+	svc := newService(s, ServiceConfig{Name: name})
+	svc.err = fmt.Errorf("service %s not configured", name)
+	s.unknown[name] = svc
+	return svc
+}
+
+// setRequestID 请求未携带请求ID时生成, 并在响应中返回
+func setRequestID(ginCtx *gin.Context) {
+	requestID := ginCtx.GetHeader(log.RequestIDHeader)
+	if requestID == "" {
+		b := make([]byte, 16)
+		_, _ = rand.Read(b)
+		requestID = hex.EncodeToString(b)
+		ginCtx.Request.Header.Set(log.RequestIDHeader, requestID)
+	}
+	ginCtx.Header(log.RequestIDHeader, requestID)
+}
+
+// traceEnabled 请求是否开启trace日志, getHeader获取请求头
+func (s *Server) traceEnabled(getHeader func(key string) string) bool {
+	header := s.currentConfig().Server.TraceHeader
+	if header == "" {
+		return false
 	}
-	s.engine.Any(method, h)
+	enabled, _ := strconv.ParseBool(getHeader(header))
+	return enabled
+}
+
+// currentConfig 当前生效的配置, 同一进程中的多个Server各自使用自己的配置
+func (s *Server) currentConfig() *Config {
+	return s.current.Load().(*Config)
 }
 
-// Start 启动服务
+// Start 启动所有服务, 阻塞直到服务停止, 调用Shutdown或热重启完成时返回nil
+// 任一服务监听或运行失败时停止所有服务并返回错误
+// 由热重启启动的进程使用父进程传递的listener, 开始监听后通知父进程退出
 func (s *Server) Start() error {
-	cfg := GetGlobalConfig()
-	addr := fmt.Sprintf("%s:%d", cfg.Server.Ip, cfg.Server.Port)
-	log.Infof("server start, listen addr: %s", addr)
-	if err := s.engine.Run(addr); err != nil {
-		return err
+	s.mutex.Lock()
+	for name, svc := range s.unknown {
+		s.mutex.Unlock()
+		return fmt.Errorf("register on service %s: %v", name, svc.err)
 	}
-	return nil
+	s.mutex.Unlock()
+	// 在业务注册路由之后注册, 业务已实现的探测接口不重复注册
+	s.registerHealth()
+	for i, svc := range s.services {
+		listener := s.opts.listeners[svc.cfg.Name]
+		if i == 0 && listener == nil {
+			listener = s.opts.listeners[""]
+		}
+		if listener == nil {
+			listener = takeInheritedListener(svc.cfg.Name)
+		}
+		if err := svc.listen(listener); err != nil {
+			_ = s.shutdownServices(context.Background())
+			return err
+		}
+	}
+	notifyParentReady()
+	if s.cfg.Server.HotRestart {
+		stop := s.watchRestartSignal()
+		s.mutex.Lock()
+		s.stopSignal = stop
+		s.mutex.Unlock()
+	}
+	errCh := make(chan error, len(s.services))
+	for _, svc := range s.services {
+		go func(svc *Service) {
+			errCh <- svc.serve()
+		}(svc)
+	}
+	var firstErr error
+	for range s.services {
+		if err := <-errCh; err != nil && firstErr == nil {
+			firstErr = err
+			_ = s.shutdownServices(context.Background())
+		}
+	}
+	return firstErr
 }
 
-func getServerConfigPath() string {
-	// 如果是默认配置文件，则从命令行参数中获取
-	if GlobalServerConfigFile == defaultConfigFile {
-		flag.StringVar(&GlobalServerConfigFile, "conf", defaultConfigFile, "server config file")
-		flag.Parse()
+// Shutdown 停止所有服务, 等待处理中的请求完成, 并停止配置监听
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.shutdown(ctx, true)
+}
+
+// shutdown 停止服务, drain为true时先使readyz失败并等待shutdown_delay
+// 热重启时新进程共用监听端口继续服务, 不需要摘除流量
+func (s *Server) shutdown(ctx context.Context, drain bool) error {
+	if s.stopWatch != nil {
+		s.stopWatch()
+	}
+	if s.unsubscribe != nil {
+		s.unsubscribe()
+	}
+	s.mutex.Lock()
+	stopSignal := s.stopSignal
+	s.mutex.Unlock()
+	if stopSignal != nil {
+		stopSignal()
 	}
+	if drain {
+		s.drain(ctx)
+	}
+	err := s.shutdownServices(ctx)
+	if e := s.shutdownTracing(ctx); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+func (s *Server) shutdownServices(ctx context.Context) error {
+	var firstErr error
+	for _, svc := range s.services {
+		if err := svc.shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+var (
+	parseFlagsOnce  sync.Once
+	checkConfigOnly bool
+	printConfigOnly bool
+)
+
+func getServerConfigPath() string {
+	parseFlagsOnce.Do(func() {
+		// 如果是默认配置文件，则从命令行参数中获取
+		if GlobalServerConfigFile == defaultConfigFile {
+			flag.StringVar(&GlobalServerConfigFile, "conf", defaultConfigFile,
+				"server config files or urls, separated by comma, merged in order, "+
+					"e.g. base.yaml,prod.yaml or http://config-center/otz_go.yaml")
+			flag.Var((*overrideFlag)(&GlobalConfigOverrides), "set",
+				"override config, e.g. -set server.port=8080, can be repeated")
+			flag.BoolVar(&checkConfigOnly, "check-config", false, "validate config and exit")
+			flag.BoolVar(&printConfigOnly, "print-config", false, "print effective config with secrets masked and exit")
+			flag.Parse()
+		}
+	})
 	// 否则可以从全局变量中获取 - 允许用户设置,也便于单测
 	return GlobalServerConfigFile
 }
 
-type logParser struct {
-	node *yaml.Node
+// getServerConfigPaths 配置地址列表, 多个以逗号分隔, 按scheme选择ConfigProvider
+func getServerConfigPaths() []string {
+	paths := []string{}
+	for _, p := range strings.Split(getServerConfigPath(), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// loggerHolder atomic.Value中保存的日志, 不同实现的日志类型不同
+type loggerHolder struct {
+	logger log.Logger
 }
 
-// Parse 解析日志配置
-func (p *logParser) Parse(dst interface{}) error {
-	if p.node == nil {
-		return errors.New("node is nil")
+// getLogger 服务的日志, 非全局服务未配置log时使用默认日志
+func (s *Server) getLogger() log.Logger {
+	if h, ok := s.logger.Load().(loggerHolder); ok && h.logger != nil {
+		return h.logger
 	}
-	return p.node.Decode(dst)
+	return log.GetDefaultLogger()
 }
 
-// NewServer 创建服务
-func NewServer() *Server {
-	s := &Server{}
-	// 加载服务配置
-	cfg, err := LoadConfig(getServerConfigPath())
+// infof 使用服务的日志输出框架日志, 与log包函数一样经过一层调用, 日志中的调用位置正确
+func (s *Server) infof(format string, args ...interface{}) {
+	s.getLogger().Infof(format, args...)
+}
+
+func (s *Server) warnf(format string, args ...interface{}) {
+	s.getLogger().Warnf(format, args...)
+}
+
+func (s *Server) errorf(format string, args ...interface{}) {
+	s.getLogger().Errorf(format, args...)
+}
+
+// setupLogger 使用WithLogger指定的日志或按配置中的log创建服务的日志, oldCfg为空或log变化时创建
+// 非全局服务未配置log时使用默认日志, 全局服务未配置log时输出到控制台
+func (s *Server) setupLogger(oldCfg, newCfg *Config) error {
+	if s.opts.logger != nil {
+		s.logger.Store(loggerHolder{logger: s.opts.logger})
+		return nil
+	}
+	if !configChanged(oldCfg, newCfg, "log") {
+		return nil
+	}
+	var logger log.Logger
+	switch {
+	case newCfg.Log.Kind != 0:
+		cfgs := []log.Config{}
+		if err := newCfg.Log.Decode(&cfgs); err != nil {
+			return errors.New("parse log config failed, err: " + err.Error())
+		}
+		logger = log.NewZapLog(cfgs...)
+	case s.opts.global:
+		logger = log.NewZapLog(log.Config{OutputType: log.OutputTypeConsole})
+	}
+	s.logger.Store(loggerHolder{logger: logger})
+	return nil
+}
+
+// applyGlobalLogConfig 全局服务将自己的日志设置为默认日志并应用进程级的日志配置
+// oldCfg为空时全部应用, 否则只应用有变化的部分
+func (s *Server) applyGlobalLogConfig(oldCfg, newCfg *Config) error {
+	if configChanged(oldCfg, newCfg, "log") {
+		log.SetDefaultLogger(s.getLogger())
+	}
+	if configChanged(oldCfg, newCfg, "log_escalation") {
+		log.SetEscalation(newCfg.LogEscalation)
+	}
+	if configChanged(oldCfg, newCfg, "log_fields") {
+		if err := log.EnableFieldExtractors(newCfg.LogFields...); err != nil {
+			return errors.New("enable log fields failed, err: " + err.Error())
+		}
+	}
+	if configChanged(oldCfg, newCfg, "log_webhook") {
+		if newCfg.LogWebhook.URL == "" {
+			log.RemoveHook(log.WebhookHookName)
+		} else if _, err := log.SetupWebhook(newCfg.LogWebhook); err != nil {
+			return errors.New("setup log webhook failed, err: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// applyConfig 替换服务当前的配置并应用日志配置, 全局服务同时应用进程级的日志配置
+func (s *Server) applyConfig(oldCfg, newCfg *Config) {
+	s.current.Store(newCfg)
+	err := s.setupLogger(oldCfg, newCfg)
+	if err == nil && s.opts.global {
+		err = s.applyGlobalLogConfig(oldCfg, newCfg)
+	}
 	if err != nil {
-		panic(err)
+		s.errorf("apply log config failed, err: %v", err)
 	}
-	// 设置全局变量
-	SetGlobalConfig(cfg)
+}
 
-	// 初始化日志
-	parser := &logParser{node: &cfg.Log}
-	err = log.SetDefaultWithLoader(parser)
+// ReloadConfig 从服务的配置来源重新加载配置, 校验失败时保留原配置并返回错误
+// 非全局服务只替换自己的配置, 不影响全局配置及其他服务; 全局服务重新加载全局配置并通知订阅者
+func (s *Server) ReloadConfig() error {
+	if len(s.providers) == 0 {
+		return errors.New("server created with WithConfig, no config source to reload")
+	}
+	if s.opts.global {
+		return ReloadConfigFrom(s.providers...)
+	}
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+	newCfg, err := LoadConfigFrom(s.providers...)
 	if err != nil {
-		panic(errors.New("parse log config failed, err: " + err.Error()))
+		return err
 	}
+	s.applyConfig(s.currentConfig(), newCfg)
+	return nil
+}
 
-	// 创建gin引擎
-	gin.DefaultWriter = ioutil.Discard
-	gin.DefaultErrorWriter = ioutil.Discard
-	gin.SetMode(gin.ReleaseMode)
-	engine := gin.New()
-	engine.Use(gin.Recovery())
-	s.engine = engine
+// checkConfigAndExit -check-config 模式, 输出校验结果后退出
+func checkConfigAndExit(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config check failed:\n%v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("config %s is valid\n", GlobalServerConfigFile)
+	os.Exit(0)
+}
 
+// NewServer 创建服务, 从命令行参数 -conf 读取配置文件, 出错时panic
+// 支持 -set 覆盖配置, -check-config 校验配置后退出, -print-config 输出配置后退出
+// opts在配置文件之后应用, 如 WithListener
+func NewServer(opts ...Option) *Server {
+	uris := getServerConfigPaths()
+	if checkConfigOnly || printConfigOnly {
+		cfg, err := LoadConfig(uris...)
+		if checkConfigOnly {
+			checkConfigAndExit(err)
+		}
+		if err == nil {
+			fmt.Print(cfg.Dump())
+			os.Exit(0)
+		}
+	}
+	s, err := New(append([]Option{WithConfigFile(uris...), WithGlobal()}, opts...)...)
+	if err != nil {
+		panic(err)
+	}
 	return s
 }
+
+// New 创建服务, 不解析命令行参数, 可以在同一进程中创建多个
+// 服务使用自己的配置及日志, 配置热加载只替换自己的配置, 不修改全局配置及默认日志等进程级状态
+// 进程的主服务使用WithGlobal设置为全局服务, 见WithGlobal
+func New(opts ...Option) (*Server, error) {
+	s := &Server{opts: newOptions(opts...), unknown: map[string]*Service{}}
+	// 加载服务配置
+	cfg := s.opts.config
+	var providers []ConfigProvider
+	if cfg == nil {
+		for _, uri := range s.opts.configURIs {
+			p, err := NewConfigProvider(uri)
+			if err != nil {
+				return nil, err
+			}
+			providers = append(providers, p)
+		}
+		providers = append(providers, s.opts.providers...)
+		var err error
+		if cfg, err = LoadConfigFrom(providers...); err != nil {
+			return nil, err
+		}
+	} else if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	s.cfg = cfg
+	s.providers = providers
+	s.current.Store(cfg)
+	// 初始化服务的日志, 全局服务在创建成功后设置为默认日志
+	if err := s.setupLogger(nil, cfg); err != nil {
+		return nil, err
+	}
+
+	// 创建gin引擎, gin的运行模式为进程级设置
+	if s.opts.global {
+		gin.DefaultWriter = ioutil.Discard
+		gin.DefaultErrorWriter = ioutil.Discard
+	}
+	// 模式相同时不重复设置, 避免与同进程中运行的服务并发读写
+	if s.opts.ginMode != "" && s.opts.ginMode != gin.Mode() {
+		gin.SetMode(s.opts.ginMode)
+	}
+	for _, svcCfg := range cfg.serviceConfigs() {
+		s.services = append(s.services, newService(s, svcCfg))
+	}
+	if cfg.Server.Admin.Enabled() {
+		admin, err := s.newAdminService(cfg.Server.Admin)
+		if err != nil {
+			return nil, err
+		}
+		s.services = append(s.services, admin)
+	}
+	if err := s.setupTracing(); err != nil {
+		return nil, err
+	}
+
+	// 创建成功后再修改全局状态及监听配置变化, 创建失败时不残留
+	if s.opts.global {
+		if err := s.applyGlobalLogConfig(nil, cfg); err != nil {
+			_ = s.shutdownTracing(context.Background())
+			return nil, err
+		}
+		SetGlobalConfig(cfg)
+		// 全局配置热加载(包括业务调用ReloadConfig)时同步更新
+		s.unsubscribe = Subscribe("", s.applyConfig)
+	}
+	if cfg.Server.WatchConfig && len(providers) > 0 {
+		s.stopWatch = watchConfig(cfg.Server.WatchInterval, providers, s.infof, s.errorf, s.ReloadConfig, s.currentConfig)
+	}
+	return s, nil
+}
@@ -2,29 +2,357 @@ package otz
 
 import (
 	"context"
+	"encoding/json"
 	"github.com/ShadowsGtt/otz/log"
+	"github.com/ShadowsGtt/otz/log/logtest"
+	"github.com/ShadowsGtt/otz/otzctx"
 	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
 
 func TestNewServer(t *testing.T) {
 	GlobalServerConfigFile = "./test.yaml"
-	s := NewServer()
-	logCtx := log.NewLogCtx(context.Background())
-	ctx := logCtx.GetCtx()
+	// 使用随机端口, 忽略配置中的端口
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(WithListener(ln))
+	otzCtx := otzctx.NewOtzContext(context.Background())
+	defer otzctx.PutOTZCtx(otzCtx)
+	ctx := otzCtx.Context()
 	log.WithCtx(ctx, "method", "TestNewServer")
 
 	log.Debugf("server start")
 	log.InfoCtxf(ctx, "server start...")
 
-	s.Register("/test", func(c *gin.Context) {
-		c.JSON(200, gin.H{
+	s.Register("/test", func(ctx context.Context) {
+		c := otzctx.OTZContext(ctx).GetGinCtx()
+		c.JSON(200, map[string]string{
 			"message": "pong",
 		})
-		log.Infof("server request, time: %s", time.Now().Format("2006-01-02 15:04:05"))
+		log.TraceCtxf(ctx, "trace request")
+		log.InfoCtxf(ctx, "server request, time: %s", time.Now().Format("2006-01-02 15:04:05"))
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Start()
+	}()
+	defer func() {
+		if err := s.Shutdown(context.Background()); err != nil {
+			t.Error(err)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("start should return nil after shutdown, got: %v", err)
+		}
+	}()
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+ln.Addr().String()+"/test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Otz-Trace", "true")
+	var rsp *http.Response
+	for i := 0; i < 50; i++ {
+		rsp, err = http.DefaultClient.Do(req)
+		if err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %d", rsp.StatusCode)
+	}
+}
+
+func TestLogRuleAdmin(t *testing.T) {
+	cfg, err := ParseConfig("otz_go.yaml", []byte(`server:
+  ip: 127.0.0.1
+  port: 8080
+  admin:
+    address: 127.0.0.1:0
+    token: admin-token
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(WithConfig(cfg), WithLogger(logtest.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RegisterLogRuleAdmin("/admin/log/rules")
+
+	// 只注册在管理端口上, 并校验token
+	w := httptest.NewRecorder()
+	s.services[0].engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/log/rules", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("rule admin should not be exposed on default service, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.Admin().engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/log/rules", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("rule admin should require token, got %d", w.Code)
+	}
+
+	do := func(method, path, body string) map[string]interface{} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-token")
+		s.Admin().engine.ServeHTTP(w, req)
+		rsp := map[string]interface{}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+			t.Fatal(err)
+		}
+		return rsp
+	}
+	rsp := do(http.MethodPost, "/admin/log/rules", `{"user_id":"u1","ttl":60}`)
+	if rsp["code"].(float64) != 0 {
+		t.Fatalf("add rule failed: %v", rsp)
+	}
+	id := rsp["data"].(map[string]interface{})["id"].(string)
+	if _, ok := log.MatchLevelRule("u1", "/test"); !ok {
+		t.Fatal("rule should match")
+	}
+	if rsp = do(http.MethodPost, "/admin/log/rules", `{"level":"bad","user_id":"u1","ttl":60}`); rsp["code"].(float64) == 0 {
+		t.Fatalf("invalid rule should be rejected: %v", rsp)
+	}
+	if rsp = do(http.MethodDelete, "/admin/log/rules/"+id, ""); rsp["code"].(float64) != 0 {
+		t.Fatalf("remove rule failed: %v", rsp)
+	}
+	if _, ok := log.MatchLevelRule("u1", "/test"); ok {
+		t.Fatal("rule should be removed")
+	}
+}
+
+func TestNew(t *testing.T) {
+	cfg, err := ParseConfig("otz_go.yaml", []byte("server:\n  trace_header: X-Otz-Trace\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := logtest.New()
+
+	// 同一进程中创建多个服务
+	urls := make([]string, 0, 2)
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := New(WithConfig(cfg), WithLogger(recorder), WithGinMode(gin.TestMode), WithListener(ln))
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := strconv.Itoa(i)
+		s.Register("/name", func(ctx context.Context) {
+			otzctx.OTZContext(ctx).GetGinCtx().String(http.StatusOK, name)
+		})
+		done := make(chan error, 1)
+		go func() {
+			done <- s.Start()
+		}()
+		defer func() {
+			if err := s.Shutdown(context.Background()); err != nil {
+				t.Error(err)
+			}
+			if err := <-done; err != nil {
+				t.Errorf("start should return nil after shutdown, got: %v", err)
+			}
+		}()
+		urls = append(urls, "http://"+ln.Addr().String()+"/name")
+	}
+	for i, url := range urls {
+		rsp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if string(body) != strconv.Itoa(i) {
+			t.Fatalf("unexpected response from server %d: %s", i, body)
+		}
+	}
+	recorder.AssertLogged(t, log.LevelInfo, "URI: /name")
+
+	if _, err = New(WithConfigFile(filepath.Join(t.TempDir(), "not_exist.yaml"))); err == nil {
+		t.Fatal("missing config file should return error")
+	}
+	if _, err = New(WithConfig(&Config{})); err == nil {
+		t.Fatal("invalid config should return error")
+	}
+}
+
+func TestServices(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "otz.sock")
+	cfg, err := ParseConfig("otz_go.yaml", []byte(`server:
+  services:
+    - name: api
+      address: 127.0.0.1:0
+    - name: admin
+      address: 127.0.0.1:0
+      interceptors: [test_auth]
+    - name: local
+      network: unix
+      address: `+sock+`
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterInterceptor("test_auth", func(ctx context.Context, next HandlerFunc) {
+		c := otzctx.OTZContext(ctx).GetGinCtx()
+		if c.GetHeader("X-Token") != "admin" {
+			c.String(http.StatusForbidden, "forbidden")
+			return
+		}
+		next(ctx)
+	})
+	s, err := New(WithConfig(cfg), WithLogger(logtest.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := func(body string) func(ctx context.Context) {
+		return func(ctx context.Context) {
+			otzctx.OTZContext(ctx).GetGinCtx().String(http.StatusOK, body)
+		}
+	}
+	s.Register("/who", reply("api"))
+	s.Service("admin").Register("/who", reply("admin"))
+	local := s.Service("local")
+	local.Use(func(ctx context.Context, next HandlerFunc) {
+		otzctx.OTZContext(ctx).GetGinCtx().Header("X-Local", "true")
+		next(ctx)
+	})
+	local.Register("/who", reply("local"))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Start()
+	}()
+	for i := 0; i < 50 && s.Service("admin").Addr() == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	get := func(client *http.Client, url string, header http.Header) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rsp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		body, _ := ioutil.ReadAll(rsp.Body)
+		return rsp.StatusCode, string(body)
+	}
+	if _, body := get(http.DefaultClient, "http://"+s.Service("api").Addr().String()+"/who", nil); body != "api" {
+		t.Fatalf("unexpected api response: %s", body)
+	}
+	adminURL := "http://" + s.Service("admin").Addr().String() + "/who"
+	if code, _ := get(http.DefaultClient, adminURL, nil); code != http.StatusForbidden {
+		t.Fatalf("admin interceptor should reject, got %d", code)
+	}
+	if _, body := get(http.DefaultClient, adminURL, http.Header{"X-Token": {"admin"}}); body != "admin" {
+		t.Fatalf("unexpected admin response: %s", body)
+	}
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+	if _, body := get(unixClient, "http://local/who", nil); body != "local" {
+		t.Fatalf("unexpected local response: %s", body)
+	}
+
+	if err = s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err = net.Dial("unix", sock); err == nil {
+		t.Fatal("unix socket should be closed after shutdown")
+	}
+
+	// 注册到未配置的服务
+	s, err = New(WithConfig(cfg), WithLogger(logtest.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Service("internal").Register("/who", reply("internal"))
+	if err = s.Start(); err == nil || !strings.Contains(err.Error(), "service internal not configured") {
+		t.Fatalf("unexpected start error: %v", err)
+	}
+
+	_, err = ParseConfig("otz_go.yaml", []byte("server:\n  services:\n    - name: api\n      network: udp\n      address: :80\n"))
+	if err == nil || !strings.Contains(err.Error(), "server.services[0].network: must be one of tcp, unix") {
+		t.Fatalf("unexpected validate error: %v", err)
+	}
+}
+
+func TestTraceHeaderPerServer(t *testing.T) {
+	newServer := func(content string) *Server {
+		cfg, err := ParseConfig("otz_go.yaml", []byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := New(WithConfig(cfg), WithLogger(logtest.New()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	traced := newServer("server:\n  trace_header: X-Otz-Trace\n")
+	// 后创建的Server不影响之前Server的trace header
+	plain := newServer("server:\n  port: 8080\n")
+	header := http.Header{}
+	header.Set("X-Otz-Trace", "true")
+	if !traced.traceEnabled(header.Get) || plain.traceEnabled(header.Get) {
+		t.Fatal("trace header should follow the config of the owning server")
+	}
+}
+
+func TestInterceptorsListenTwice(t *testing.T) {
+	calls := 0
+	RegisterInterceptor("test_count", func(ctx context.Context, next HandlerFunc) {
+		calls++
+		next(ctx)
 	})
-	if err := s.Start(); err != nil {
-		log.Fatal(err)
+	cfg, err := ParseConfig("otz_go.yaml", []byte(`server:
+  services:
+    - name: api
+      address: 127.0.0.1:0
+      interceptors: [test_count]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(WithConfig(cfg), WithLogger(logtest.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Register("/ping", func(ctx context.Context) {})
+	svc := s.Service("api")
+	// 启动失败后重新启动时配置的拦截器不重复添加
+	for i := 0; i < 2; i++ {
+		if err = svc.listen(nil); err != nil {
+			t.Fatal(err)
+		}
+		_ = svc.listener.Close()
+	}
+	svc.engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ping", nil))
+	if calls != 1 {
+		t.Fatalf("configured interceptor should run once, got %d", calls)
 	}
 }
@@ -2,7 +2,9 @@ package otzctx
 
 import (
 	"context"
+	"crypto/x509"
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
 	"sync"
 )
 
@@ -22,13 +24,65 @@ type Context interface {
 	GetLogger() interface{}
 	SetGinCtx(*gin.Context)
 	GetGinCtx() *gin.Context
+	SetPeer(*Peer)
+	GetPeer() *Peer
+	SetRequest(*Request)
+	GetRequest() *Request
+	SetError(error)
+	GetError() error
+	SetSpan(trace.Span)
+	GetSpan() trace.Span
 	Context() context.Context
 }
 
+// Request 与协议无关的请求信息, 非http请求(如grpc)通过它提供日志字段及日志等级提升所需的信息
+type Request struct {
+	Protocol string // http/grpc
+	Route    string // 路由, grpc为方法全名 /package.Service/Method
+	ClientIP string
+	// Header 获取请求头, grpc为metadata, 不区分大小写
+	Header func(key string) string
+}
+
+// GetHeader 获取请求头, 未设置Header时返回空
+func (r *Request) GetHeader(key string) string {
+	if r == nil || r.Header == nil {
+		return ""
+	}
+	return r.Header(key)
+}
+
+// Peer mTLS校验通过的客户端身份
+type Peer struct {
+	CommonName     string
+	DNSNames       []string
+	URIs           []string
+	EmailAddresses []string
+	Certificate    *x509.Certificate // 客户端证书
+}
+
+// NewPeer 从客户端证书创建Peer
+func NewPeer(cert *x509.Certificate) *Peer {
+	p := &Peer{
+		CommonName:     cert.Subject.CommonName,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		Certificate:    cert,
+	}
+	for _, u := range cert.URIs {
+		p.URIs = append(p.URIs, u.String())
+	}
+	return p
+}
+
 type otzContext struct {
 	logger  interface{}
 	context context.Context
 	ginCtx  *gin.Context
+	peer    *Peer
+	request *Request
+	err     error
+	span    trace.Span
 }
 
 // SetLogger 设置logger
@@ -51,6 +105,47 @@ func (ctx *otzContext) GetGinCtx() *gin.Context {
 	return ctx.ginCtx
 }
 
+// SetPeer 设置客户端身份
+func (ctx *otzContext) SetPeer(peer *Peer) {
+	ctx.peer = peer
+}
+
+// GetPeer 获取mTLS校验通过的客户端身份, 非mTLS请求为nil
+func (ctx *otzContext) GetPeer() *Peer {
+	return ctx.peer
+}
+
+// SetRequest 设置请求信息
+func (ctx *otzContext) SetRequest(request *Request) {
+	ctx.request = request
+}
+
+// GetRequest 获取请求信息
+func (ctx *otzContext) GetRequest() *Request {
+	return ctx.request
+}
+
+// SetError 设置请求错误, 拦截器中断请求时设置, 作为请求的返回错误
+// http接口的handler自行写响应时也可以设置, 错误码(errs.Code)记录到请求指标的code标签
+func (ctx *otzContext) SetError(err error) {
+	ctx.err = err
+}
+
+// GetError 获取请求错误
+func (ctx *otzContext) GetError() error {
+	return ctx.err
+}
+
+// SetSpan 设置请求的span, 由链路追踪拦截器设置
+func (ctx *otzContext) SetSpan(span trace.Span) {
+	ctx.span = span
+}
+
+// GetSpan 获取请求的span, 未开启链路追踪时为nil
+func (ctx *otzContext) GetSpan() trace.Span {
+	return ctx.span
+}
+
 // Context 获取context
 func (ctx *otzContext) Context() context.Context {
 	return ctx.context
@@ -92,5 +187,9 @@ func PutOTZCtx(ctx Context) {
 	v.logger = nil
 	v.ginCtx = nil
 	v.logger = nil
+	v.peer = nil
+	v.request = nil
+	v.err = nil
+	v.span = nil
 	ctxPool.Put(ctx)
 }
@@ -0,0 +1,223 @@
+package otz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ShadowsGtt/otz/log"
+	"github.com/gin-gonic/gin"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 热重启传递给子进程的环境变量, 不能使用ConfigEnvPrefix前缀, 否则会被当作配置覆盖
+const (
+	// envInheritListeners 父进程传递的listener, 格式 service:fd,service:fd
+	envInheritListeners = "OTZRESTART_INHERIT_LISTENERS"
+	// envReadyFD 子进程启动完成后写入该fd通知父进程
+	envReadyFD = "OTZRESTART_READY_FD"
+
+	defaultShutdownTimeout = 30 * time.Second
+	restartReadyTimeout    = 30 * time.Second
+)
+
+var (
+	inheritOnce      sync.Once
+	inheritMutex     sync.Mutex
+	inheritListeners map[string]net.Listener
+	inheritReady     *os.File
+)
+
+// loadInherited 解析父进程传递的listener, 只解析一次, 解析后清理环境变量避免再传给孙进程
+func loadInherited() {
+	inheritOnce.Do(func() {
+		inheritListeners = map[string]net.Listener{}
+		for _, item := range strings.Split(os.Getenv(envInheritListeners), ",") {
+			idx := strings.LastIndexByte(item, ':')
+			if idx <= 0 {
+				continue
+			}
+			fd, err := strconv.Atoi(item[idx+1:])
+			if err != nil {
+				continue
+			}
+			f := os.NewFile(uintptr(fd), item[:idx])
+			ln, err := net.FileListener(f)
+			_ = f.Close()
+			if err != nil {
+				log.Errorf("inherit listener %s failed, err: %v", item, err)
+				continue
+			}
+			inheritListeners[item[:idx]] = ln
+		}
+		if fd, err := strconv.Atoi(os.Getenv(envReadyFD)); err == nil {
+			inheritReady = os.NewFile(uintptr(fd), "ready")
+		}
+		_ = os.Unsetenv(envInheritListeners)
+		_ = os.Unsetenv(envReadyFD)
+	})
+}
+
+// takeInheritedListener 取出父进程传递的服务listener, 每个只能使用一次
+func takeInheritedListener(name string) net.Listener {
+	loadInherited()
+	inheritMutex.Lock()
+	defer inheritMutex.Unlock()
+	ln := inheritListeners[name]
+	delete(inheritListeners, name)
+	return ln
+}
+
+// notifyParentReady 所有服务开始监听后通知父进程退出
+func notifyParentReady() {
+	loadInherited()
+	inheritMutex.Lock()
+	defer inheritMutex.Unlock()
+	if inheritReady == nil {
+		return
+	}
+	_, _ = inheritReady.Write([]byte{1})
+	_ = inheritReady.Close()
+	inheritReady = nil
+}
+
+// Restart 热重启: 启动新的进程并传递所有服务的listener, 新进程开始监听后当前进程停止接收请求,
+// 等待处理中的请求完成后Start返回, 连接不会中断. 新进程启动失败时当前进程继续服务并返回错误
+func (s *Server) Restart() error {
+	s.mutex.Lock()
+	if s.restarting {
+		s.mutex.Unlock()
+		return errors.New("server is restarting")
+	}
+	s.restarting = true
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		s.restarting = false
+		s.mutex.Unlock()
+	}()
+
+	files := make([]*os.File, 0, len(s.services)+1)
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	specs := make([]string, 0, len(s.services))
+	for _, svc := range s.services {
+		f, err := svc.file()
+		if err != nil {
+			return err
+		}
+		// ExtraFiles在子进程中的fd从3开始
+		specs = append(specs, fmt.Sprintf("%s:%d", svc.cfg.Name, 3+len(files)))
+		files = append(files, f)
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+	readyFD := 3 + len(files)
+	files = append(files, readyW)
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(),
+		envInheritListeners+"="+strings.Join(specs, ","),
+		envReadyFD+"="+strconv.Itoa(readyFD),
+	)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("start new process failed: %v", err)
+	}
+	// 关闭父进程持有的写端, 子进程退出时读端返回EOF
+	_ = readyW.Close()
+	files = files[:len(files)-1]
+
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		if _, err := readyR.Read(b); err != nil {
+			ready <- fmt.Errorf("new process %d exited before ready", cmd.Process.Pid)
+			return
+		}
+		ready <- nil
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(restartReadyTimeout):
+		_ = cmd.Process.Kill()
+		err = fmt.Errorf("new process %d not ready in %s", cmd.Process.Pid, restartReadyTimeout)
+	}
+	if err != nil {
+		_, _ = cmd.Process.Wait()
+		return err
+	}
+	_ = cmd.Process.Release()
+	s.infof("new process %d ready, shutdown current process %d", cmd.Process.Pid, os.Getpid())
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout())
+		defer cancel()
+		if err := s.shutdown(ctx, false); err != nil {
+			s.errorf("shutdown after restart failed, err: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (s *Server) shutdownTimeout() time.Duration {
+	if s.cfg.Server.ShutdownTimeout > 0 {
+		return s.cfg.Server.ShutdownTimeout
+	}
+	return defaultShutdownTimeout
+}
+
+// watchRestartSignal 收到SIGUSR2时热重启, 返回停止监听函数
+func (s *Server) watchRestartSignal() (stop func()) {
+	if len(restartSignals) == 0 {
+		return func() {}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, restartSignals...)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-ch:
+				s.infof("receive signal %s, restart server", sig)
+				if err := s.Restart(); err != nil {
+					s.errorf("restart server failed, keep serving, err: %v", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(done)
+		})
+	}
+}
+
+// RegisterRestartAdmin 在管理端口上注册热重启接口 POST path, 新进程就绪后返回
+// 使用server.admin配置的token及IP白名单校验, 未配置server.admin.address时Start返回错误
+func (s *Server) RegisterRestartAdmin(path string) {
+	s.Admin().engine.POST(path, func(ginCtx *gin.Context) {
+		writeAdminRsp(ginCtx, nil, s.Restart())
+	})
+}
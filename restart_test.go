@@ -0,0 +1,181 @@
+//go:build !windows
+
+package otz
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/ShadowsGtt/otz/log/logtest"
+	"github.com/ShadowsGtt/otz/otzctx"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const restartHelperEnv = "OTZ_TEST_RESTART_HELPER"
+
+// TestRestartHelper 热重启测试的服务进程, 由TestHotRestart启动
+func TestRestartHelper(t *testing.T) {
+	if os.Getenv(restartHelperEnv) == "" {
+		t.Skip("helper process of TestHotRestart")
+	}
+	cfg, err := ParseConfig("otz_go.yaml", []byte(`server:
+  hot_restart: true
+  shutdown_timeout: 5s
+  health:
+    shutdown_delay: 5s
+  services:
+    - name: api
+      address: 127.0.0.1:0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 独立进程中的主服务
+	s, err := New(WithConfig(cfg), WithLogger(logtest.New()), WithGlobal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Register("/pid", func(ctx context.Context) {
+		otzctx.OTZContext(ctx).GetGinCtx().String(http.StatusOK, strconv.Itoa(os.Getpid()))
+	})
+	go func() {
+		for s.Service("api").Addr() == nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+		fmt.Printf("addr=%s\n", s.Service("api").Addr())
+	}()
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHotRestart(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRestartHelper$")
+	cmd.Env = append(os.Environ(), restartHelperEnv+"=1")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	addr := ""
+	scanner := bufio.NewScanner(stdout)
+	for addr == "" && scanner.Scan() {
+		addr = strings.TrimPrefix(scanner.Text(), "addr=")
+	}
+	go func() {
+		_, _ = ioutil.ReadAll(stdout)
+	}()
+	getPid := func() (int, error) {
+		rsp, err := http.Get("http://" + addr + "/pid")
+		if err != nil {
+			return 0, err
+		}
+		defer rsp.Body.Close()
+		body, _ := ioutil.ReadAll(rsp.Body)
+		return strconv.Atoi(string(body))
+	}
+	pid, err := getPid()
+	if err != nil || pid != cmd.Process.Pid {
+		t.Fatalf("unexpected pid %d, err: %v", pid, err)
+	}
+
+	if err = cmd.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	// 重启过程中请求不失败, 直到由新进程处理
+	childPid := 0
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		if pid, err = getPid(); err != nil {
+			t.Fatalf("request failed during restart: %v", err)
+		}
+		if pid != cmd.Process.Pid {
+			childPid = pid
+			break
+		}
+		// 热重启时父进程与新进程共用端口, readyz不能失败
+		rsp, err := http.Get("http://" + addr + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatalf("readyz should not fail during restart, got %d", rsp.StatusCode)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if childPid == 0 {
+		t.Fatal("new process not serving")
+	}
+	defer syscall.Kill(childPid, syscall.SIGKILL)
+
+	// 父进程处理完请求后退出, 不等待shutdown_delay
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	select {
+	case err = <-exited:
+		if err != nil {
+			t.Fatalf("parent process should exit normally, got: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("parent process not exited")
+	}
+	if pid, err = getPid(); err != nil || pid != childPid {
+		t.Fatalf("new process should keep serving, pid %d, err: %v", pid, err)
+	}
+}
+
+func TestRestartAdmin(t *testing.T) {
+	// 未开启管理端口时不能注册
+	cfg, err := ParseConfig("otz_go.yaml", []byte("server:\n  ip: 127.0.0.1\n  port: 8080\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(WithConfig(cfg), WithLogger(logtest.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RegisterRestartAdmin("/admin/restart")
+	if err = s.Start(); err == nil || !strings.Contains(err.Error(), "admin server not enabled") {
+		t.Fatalf("start should fail without admin server, got %v", err)
+	}
+
+	cfg, err = ParseConfig("otz_go.yaml", []byte(`server:
+  ip: 127.0.0.1
+  port: 8080
+  admin:
+    address: 127.0.0.1:0
+    token: admin-token
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err = New(WithConfig(cfg), WithLogger(logtest.New())); err != nil {
+		t.Fatal(err)
+	}
+	s.RegisterRestartAdmin("/admin/restart")
+	w := httptest.NewRecorder()
+	s.services[0].engine.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/restart", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("restart admin should not be exposed on default service, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.Admin().engine.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/restart", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("restart admin should require token, got %d", w.Code)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package otz
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartSignals 触发热重启的信号
+var restartSignals = []os.Signal{syscall.SIGUSR2}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package otz
+
+import (
+	"os"
+)
+
+// restartSignals windows不支持SIGUSR2, 只能通过Restart或管理接口热重启
+var restartSignals []os.Signal
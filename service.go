@@ -0,0 +1,405 @@
+package otz
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/ShadowsGtt/otz/errs"
+	"github.com/ShadowsGtt/otz/log"
+	"github.com/ShadowsGtt/otz/otzctx"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const (
+	defaultServiceName = "default"
+
+	NetworkTCP  = "tcp"
+	NetworkUnix = "unix"
+)
+
+// ServiceConfig 服务配置, 每个服务独立监听, 拥有独立的路由及拦截器
+type ServiceConfig struct {
+	Name string `yaml:"name"`
+	// Type 服务类型 http/grpc/mux, 默认http, mux为同一端口提供http及grpc
+	Type    string `yaml:"type"`
+	Network string `yaml:"network"` // tcp/unix, 默认tcp
+	// Address tcp为 ip:port, unix为socket文件路径
+	Address string `yaml:"address"`
+	// Interceptors 拦截器名称, 按顺序执行, 需要先通过RegisterInterceptor注册
+	Interceptors []string `yaml:"interceptors"`
+	// TLS 配置证书后使用https
+	TLS TLSConfig `yaml:"tls"`
+	// Transport 协议及超时等参数
+	Transport TransportConfig `yaml:"transport"`
+}
+
+func (c *ServiceConfig) serviceType() string {
+	if c.Type == "" {
+		return ServiceTypeHTTP
+	}
+	return c.Type
+}
+
+// HandlerFunc 业务处理函数
+type HandlerFunc func(ctx context.Context)
+
+// Interceptor 拦截器, 调用next继续处理请求, 不调用则中断
+// 中断时可以通过 otzctx.OTZContext(ctx).SetError(err) 设置返回的错误, http请求未写响应时以json返回错误码
+// http及grpc请求共用拦截器, grpc请求中GetGinCtx为nil, 请求信息通过GetRequest获取
+type Interceptor func(ctx context.Context, next HandlerFunc)
+
+var (
+	interceptors     = map[string]Interceptor{}
+	interceptorMutex sync.RWMutex
+)
+
+// RegisterInterceptor 注册拦截器, 服务配置中通过名称引用
+func RegisterInterceptor(name string, interceptor Interceptor) {
+	interceptorMutex.Lock()
+	defer interceptorMutex.Unlock()
+	interceptors[name] = interceptor
+}
+
+func getInterceptor(name string) (Interceptor, bool) {
+	interceptorMutex.RLock()
+	defer interceptorMutex.RUnlock()
+	i, ok := interceptors[name]
+	return i, ok
+}
+
+// Service 一个监听地址上的服务
+type Service struct {
+	server       *Server
+	cfg          ServiceConfig
+	engine       *gin.Engine
+	configured   []Interceptor // 配置中的拦截器, 启动时按名称解析
+	interceptors []Interceptor // Use追加的拦截器
+	listener     net.Listener
+	rawListener  net.Listener // tls包装前的listener, 用于热重启传递fd
+	httpServer   *http.Server
+	grpcServer   *grpc.Server
+	grpcServices []grpcRegistration
+	grpcCalls    *activeTracker // mux服务中处理中的grpc请求
+	h2cConns     *activeTracker // h2c服务中处理中的连接
+	hub          *wsHub
+	err          error // 服务未配置等错误, 启动时返回
+	mutex        sync.Mutex
+}
+
+func newService(server *Server, cfg ServiceConfig) *Service {
+	if cfg.Network == "" {
+		cfg.Network = NetworkTCP
+	}
+	engine := gin.New()
+	engine.Use(gin.Recovery())
+	svc := &Service{
+		server:    server,
+		cfg:       cfg,
+		engine:    engine,
+		grpcCalls: newActiveTracker(),
+		h2cConns:  newActiveTracker(),
+		hub:       newWSHub(),
+	}
+	if svc.metricsEnabled() {
+		engine.Use(metricsMiddleware(cfg.Name))
+	}
+	return svc
+}
+
+// Name 服务名称
+func (svc *Service) Name() string {
+	return svc.cfg.Name
+}
+
+// Use 追加拦截器, 在配置的拦截器之后执行
+func (svc *Service) Use(interceptors ...Interceptor) {
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+	svc.interceptors = append(svc.interceptors, interceptors...)
+}
+
+// Register 注册接口, handler自行写响应, 业务错误通过 otzctx.OTZContext(ctx).SetError 设置
+// 设置的错误码记录到请求指标的code标签, 未设置时为0
+func (svc *Service) Register(method string, handler func(ctx context.Context)) {
+	h := func(ginCtx *gin.Context) {
+		otzCtx := svc.newHTTPContext(ginCtx)
+		defer otzctx.PutOTZCtx(otzCtx)
+		begin := time.Now()
+		defer func() {
+			if err := recover(); err != nil {
+				log.ErrorCtxf(otzCtx.Context(), "%s", string(debug.Stack()))
+				ginCtx.Data(http.StatusInternalServerError, "", nil)
+			}
+			log.InfoCtxf(otzCtx.Context(), "URI: %s, cost: %dms",
+				ginCtx.Request.URL.Path, time.Since(begin).Milliseconds(),
+			)
+		}()
+		svc.chain(func(ctx context.Context) {
+			svc.callHTTPHandler(ctx, handler)
+		})(otzCtx.Context())
+		if err := otzCtx.GetError(); err != nil {
+			ginCtx.Set(ginErrCodeKey, errs.Code(err))
+		}
+	}
+	svc.engine.Any(method, h)
+}
+
+// newHTTPContext 创建http请求的otz ctx, 设置请求id, 客户端身份及请求级logger
+// ctx基于请求的ctx创建, 客户端断开连接时取消
+func (svc *Service) newHTTPContext(ginCtx *gin.Context) otzctx.Context {
+	otzCtx := otzctx.GetOrNewOTZContext(ginCtx.Request.Context())
+	otzCtx.SetGinCtx(ginCtx)
+	if state := ginCtx.Request.TLS; state != nil && len(state.VerifiedChains) > 0 {
+		otzCtx.SetPeer(otzctx.NewPeer(state.VerifiedChains[0][0]))
+	}
+	setRequestID(ginCtx)
+	log.WithLoggerCtx(otzCtx.Context(), svc.server.getLogger())
+	if svc.server.traceEnabled(ginCtx.GetHeader) {
+		log.WithLevelCtx(otzCtx.Context(), log.LevelTrace)
+	}
+	return otzCtx
+}
+
+// writeErrorRsp 以json返回errs错误码及错误信息, 用于拦截器中断及超时等框架生成的错误响应
+func writeErrorRsp(ginCtx *gin.Context, err error) {
+	ginCtx.JSON(http.StatusOK, gin.H{
+		"code": errs.Code(err),
+		"msg":  errs.Msg(err),
+	})
+}
+
+// abortRequest 拦截器中断请求时设置响应, http请求设置了错误时返回错误响应, grpc请求未设置错误时返回PermissionDenied
+func abortRequest(ctx context.Context) {
+	otzCtx := otzctx.OTZContext(ctx)
+	err := otzCtx.GetError()
+	ginCtx := otzCtx.GetGinCtx()
+	if ginCtx == nil {
+		if err == nil {
+			otzCtx.SetError(status.Error(codes.PermissionDenied, "request rejected by interceptor"))
+		}
+		return
+	}
+	if err != nil && !ginCtx.Writer.Written() {
+		writeErrorRsp(ginCtx, err)
+	}
+}
+
+// chain 按顺序组装拦截器, 每个请求组装一次
+// 拦截器中断请求时在链路追踪内写入响应, span记录实际的响应状态
+func (svc *Service) chain(handler HandlerFunc) HandlerFunc {
+	svc.mutex.Lock()
+	chain := make([]Interceptor, 0, len(svc.configured)+len(svc.interceptors))
+	chain = append(append(chain, svc.configured...), svc.interceptors...)
+	svc.mutex.Unlock()
+	called, final := false, handler
+	handler = func(ctx context.Context) {
+		called = true
+		final(ctx)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		interceptor, next := chain[i], handler
+		handler = func(ctx context.Context) {
+			interceptor(ctx, next)
+		}
+	}
+	intercepted := handler
+	handler = func(ctx context.Context) {
+		intercepted(ctx)
+		if !called {
+			abortRequest(ctx)
+		}
+	}
+	if svc.server != nil && svc.server.tracer != nil && svc.cfg.Name != adminServiceName {
+		// 链路追踪在所有拦截器之前执行, 拦截器中的日志也带有trace_id
+		next := handler
+		handler = func(ctx context.Context) {
+			svc.server.traceRequest(ctx, next)
+		}
+	}
+	return handler
+}
+
+// Addr 监听地址, 启动前为nil
+func (svc *Service) Addr() net.Addr {
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+	if svc.listener == nil {
+		return nil
+	}
+	return svc.listener.Addr()
+}
+
+// listen 解析配置的拦截器并监听地址
+func (svc *Service) listen(listener net.Listener) error {
+	if svc.err != nil {
+		return svc.err
+	}
+	configured := make([]Interceptor, 0, len(svc.cfg.Interceptors))
+	for _, name := range svc.cfg.Interceptors {
+		interceptor, ok := getInterceptor(name)
+		if !ok {
+			return fmt.Errorf("service %s: interceptor %s not registered", svc.cfg.Name, name)
+		}
+		configured = append(configured, interceptor)
+	}
+	svcType := svc.cfg.serviceType()
+	var tlsConfig *tls.Config
+	if svc.cfg.TLS.Enabled() {
+		nextProtos := svc.cfg.Transport.nextProtos()
+		if svcType == ServiceTypeGRPC {
+			nextProtos = []string{"h2"}
+		}
+		cfg, err := newTLSConfig(svc.cfg.TLS, nextProtos)
+		if err != nil {
+			return fmt.Errorf("service %s: %v", svc.cfg.Name, err)
+		}
+		tlsConfig = cfg
+	}
+	var (
+		httpServer *http.Server
+		grpcServer *grpc.Server
+		err        error
+	)
+	switch svcType {
+	case ServiceTypeGRPC:
+		// grpc通过credentials完成tls握手, 以获取客户端身份
+		var creds credentials.TransportCredentials
+		if tlsConfig != nil {
+			creds = credentials.NewTLS(tlsConfig)
+			tlsConfig = nil
+		}
+		grpcServer = svc.newGRPCServer(creds)
+	case ServiceTypeMux:
+		grpcServer = svc.newGRPCServer(nil)
+		handler := muxHandler(grpcServer, svc.engine, svc.grpcCalls)
+		httpServer, err = newHTTPServer(svc.cfg.Transport, handler, svc.cfg.TLS.Enabled(), svc.h2cConns)
+	default:
+		httpServer, err = newHTTPServer(svc.cfg.Transport, svc.engine, svc.cfg.TLS.Enabled(), svc.h2cConns)
+	}
+	if err != nil {
+		return fmt.Errorf("service %s: %v", svc.cfg.Name, err)
+	}
+	if listener == nil {
+		if svc.cfg.Network == NetworkUnix {
+			// 清理上次异常退出残留的socket文件
+			if info, err := os.Stat(svc.cfg.Address); err == nil && info.Mode()&os.ModeSocket != 0 {
+				_ = os.Remove(svc.cfg.Address)
+			}
+		}
+		ln, err := net.Listen(svc.cfg.Network, svc.cfg.Address)
+		if err != nil {
+			return fmt.Errorf("service %s: %v", svc.cfg.Name, err)
+		}
+		listener = ln
+	}
+	rawListener := listener
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+	svc.configured = configured
+	svc.listener = listener
+	svc.rawListener = rawListener
+	svc.httpServer = httpServer
+	svc.grpcServer = grpcServer
+	return nil
+}
+
+// file 复制listener的fd, 用于热重启传递给新进程
+func (svc *Service) file() (*os.File, error) {
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+	filer, ok := svc.rawListener.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("service %s: listener %T can not be passed to new process", svc.cfg.Name, svc.rawListener)
+	}
+	// 当前进程关闭listener时不删除socket文件, 新进程继续使用
+	if ul, ok := svc.rawListener.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	return filer.File()
+}
+
+// serve 阻塞处理请求, 调用shutdown停止时返回nil
+func (svc *Service) serve() error {
+	scheme := svc.cfg.serviceType()
+	if svc.cfg.TLS.Enabled() {
+		scheme += ", tls"
+	} else if svc.cfg.Transport.Protocol == ProtocolH2C {
+		scheme += ", h2c"
+	}
+	svc.server.infof("service %s start, listen %s: %s, %s", svc.cfg.Name, svc.cfg.Network, svc.listener.Addr(), scheme)
+	var err error
+	if svc.httpServer != nil {
+		err = svc.httpServer.Serve(svc.listener)
+	} else {
+		err = svc.grpcServer.Serve(svc.listener)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, grpc.ErrServerStopped) {
+		return fmt.Errorf("service %s: %v", svc.cfg.Name, err)
+	}
+	return nil
+}
+
+// shutdown 停止服务, 等待处理中的请求完成
+func (svc *Service) shutdown(ctx context.Context) error {
+	svc.mutex.Lock()
+	httpServer, grpcServer, listener := svc.httpServer, svc.grpcServer, svc.listener
+	svc.mutex.Unlock()
+	var err error
+	if httpServer != nil {
+		err = httpServer.Shutdown(ctx)
+		// Shutdown已向h2c连接发送GOAWAY, 等待处理中的请求完成, 超时后强制关闭
+		if e := svc.h2cConns.wait(ctx); e != nil {
+			svc.h2cConns.closeConns()
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	switch {
+	case grpcServer != nil && httpServer != nil:
+		// mux服务的grpc请求由http.Server转交, grpc.Server不支持对其GracefulStop, 等待请求结束后停止
+		_ = svc.grpcCalls.wait(ctx)
+		grpcServer.Stop()
+	case grpcServer != nil:
+		stopGRPC(ctx, grpcServer)
+	}
+	// http.Server不跟踪已升级的WebSocket连接, 单独关闭
+	if wsErr := svc.hub.shutdown(ctx); err == nil {
+		err = wsErr
+	}
+	// 未开始Serve时Shutdown不会关闭listener
+	if listener != nil {
+		_ = listener.Close()
+	}
+	return err
+}
+
+// stopGRPC 等待grpc请求处理完成, 超时后强制停止
+func stopGRPC(ctx context.Context, srv *grpc.Server) {
+	done := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		srv.Stop()
+	}
+}
@@ -0,0 +1,229 @@
+package otz
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/ShadowsGtt/otz/errs"
+	"github.com/ShadowsGtt/otz/log"
+	"github.com/ShadowsGtt/otz/otzctx"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultSSEHeartbeat = 15 * time.Second
+
+// SSEEvent 一条Server-Sent Events事件, 为空的字段不发送
+type SSEEvent struct {
+	ID    string
+	Event string
+	// Data 多行数据按行拆分为多个data字段
+	Data string
+	// Retry 客户端断线重连间隔
+	Retry time.Duration
+}
+
+// SSEHandler 处理SSE请求, 通过w发送事件, 客户端断开时ctx被取消, 返回时结束事件流
+// 返回错误且事件流未断开时发送一条 event: error 事件, data为 {"code":xx,"msg":"xx"}
+// 只有errs.Error发送其错误信息, 其他错误发送 {"code":999,"msg":"internal error"}
+type SSEHandler func(ctx context.Context, w *SSEWriter) error
+
+// SSEOption SSE接口选项
+type SSEOption func(o *sseOptions)
+
+type sseOptions struct {
+	heartbeat time.Duration
+}
+
+// WithSSEHeartbeat 心跳间隔, 发送注释行避免代理断开空闲连接, 默认15s, 小于等于0不发送
+func WithSSEHeartbeat(d time.Duration) SSEOption {
+	return func(o *sseOptions) {
+		o.heartbeat = d
+	}
+}
+
+// SSEWriter 事件写入器, 每个事件写入后立即flush, 可以在多个协程中使用
+type SSEWriter struct {
+	writer  gin.ResponseWriter
+	cancel  context.CancelFunc
+	mutex   sync.Mutex
+	events  int
+	err     error
+	stopped bool
+}
+
+// errSSEStopped 事件流已结束
+var errSSEStopped = errors.New("sse stream stopped")
+
+// Send 发送一条事件
+func (w *SSEWriter) Send(e SSEEvent) error {
+	if strings.ContainsAny(e.ID, "\r\n") || strings.ContainsAny(e.Event, "\r\n") {
+		return errors.New("sse id and event must not contain newline")
+	}
+	b := strings.Builder{}
+	if e.ID != "" {
+		b.WriteString("id: " + e.ID + "\n")
+	}
+	if e.Event != "" {
+		b.WriteString("event: " + e.Event + "\n")
+	}
+	if e.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(e.Retry.Milliseconds(), 10) + "\n")
+	}
+	if e.Data != "" || (e.ID == "" && e.Event == "" && e.Retry <= 0) {
+		for _, line := range strings.Split(strings.ReplaceAll(e.Data, "\r\n", "\n"), "\n") {
+			b.WriteString("data: " + line + "\n")
+		}
+	}
+	b.WriteString("\n")
+	return w.write(b.String(), true)
+}
+
+// SendData 发送只有data的事件
+func (w *SSEWriter) SendData(data string) error {
+	return w.Send(SSEEvent{Data: data})
+}
+
+// SendJSON 发送data为json的事件
+func (w *SSEWriter) SendJSON(event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return w.Send(SSEEvent{Event: event, Data: string(data)})
+}
+
+// Events 已发送的事件数
+func (w *SSEWriter) Events() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.events
+}
+
+// write 写入并flush, 写失败时取消ctx
+func (w *SSEWriter) write(s string, event bool) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.stopped {
+		return errSSEStopped
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if _, err := w.writer.WriteString(s); err != nil {
+		w.err = err
+		w.cancel()
+		return err
+	}
+	w.writer.Flush()
+	if event {
+		w.events++
+	}
+	return nil
+}
+
+// stop 处理函数返回后禁止继续写入
+func (w *SSEWriter) stop() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.stopped = true
+}
+
+// RegisterSSE 在默认服务上注册SSE接口
+func (s *Server) RegisterSSE(path string, handler SSEHandler, opts ...SSEOption) {
+	s.services[0].RegisterSSE(path, handler, opts...)
+}
+
+// RegisterSSE 注册SSE接口 GET path, 执行拦截器后开始事件流, 事件流结束时记录一条访问日志
+// 服务配置了 transport.write_timeout 时, 超过该时间的事件流会被断开
+func (svc *Service) RegisterSSE(path string, handler SSEHandler, opts ...SSEOption) {
+	o := &sseOptions{heartbeat: defaultSSEHeartbeat}
+	for _, opt := range opts {
+		opt(o)
+	}
+	svc.engine.GET(path, func(ginCtx *gin.Context) {
+		otzCtx := svc.newHTTPContext(ginCtx)
+		defer otzctx.PutOTZCtx(otzCtx)
+		svc.chain(func(ctx context.Context) {
+			serveSSE(ctx, ginCtx, o, handler)
+		})(otzCtx.Context())
+	})
+}
+
+// serveSSE 写入响应头, 发送心跳并执行处理函数, 客户端断开时取消ctx
+func serveSSE(ctx context.Context, ginCtx *gin.Context, o *sseOptions, handler SSEHandler) {
+	begin := time.Now()
+	// gin.Context会被复用, 协程中只能使用请求的ctx
+	reqCtx := ginCtx.Request.Context()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-reqCtx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	header := ginCtx.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	if ginCtx.Request.ProtoMajor == 1 {
+		header.Set("Connection", "keep-alive")
+	}
+	ginCtx.Writer.WriteHeader(http.StatusOK)
+	ginCtx.Writer.Flush()
+	w := &SSEWriter{writer: ginCtx.Writer, cancel: cancel}
+
+	heartbeatDone := make(chan struct{})
+	if o.heartbeat > 0 {
+		go func() {
+			defer close(heartbeatDone)
+			ticker := time.NewTicker(o.heartbeat)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					_ = w.write(": heartbeat\n\n", false)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	} else {
+		close(heartbeatDone)
+	}
+
+	var err error
+	defer func() {
+		if e := recover(); e != nil {
+			log.ErrorCtxf(ctx, "%v\n%s", e, string(debug.Stack()))
+			err = errs.New(http.StatusInternalServerError, "internal error")
+		}
+		if err != nil {
+			ginCtx.Set(ginErrCodeKey, errs.Code(err))
+		}
+		if err != nil && ctx.Err() == nil {
+			// 非errs.Error的错误信息可能包含内部细节, 不发送给客户端
+			msg := "internal error"
+			if _, ok := err.(*errs.Error); ok {
+				msg = errs.Msg(err)
+			}
+			_ = w.SendJSON("error", gin.H{"code": errs.Code(err), "msg": msg})
+		}
+		cancel()
+		<-heartbeatDone
+		w.stop()
+		disconnected := reqCtx.Err() != nil || w.err != nil
+		log.InfoCtxf(ctx, "URI: %s, sse events: %d, disconnected: %t, err: %v, cost: %dms",
+			ginCtx.Request.URL.Path, w.Events(), disconnected, err, time.Since(begin).Milliseconds(),
+		)
+	}()
+	err = handler(ctx, w)
+}
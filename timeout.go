@@ -0,0 +1,125 @@
+package otz
+
+import (
+	"context"
+	"errors"
+	"github.com/ShadowsGtt/otz/errs"
+	"github.com/ShadowsGtt/otz/otzctx"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultTimeoutHeader 上游传递剩余超时时间的默认header
+const DefaultTimeoutHeader = "X-Otz-Timeout"
+
+// TimeoutConfig 请求处理超时配置, 超时后处理函数的ctx被取消, 未写响应时返回errs.CodeTimeout
+// 从服务所属Server的配置读取, 配置热加载后对新请求生效
+type TimeoutConfig struct {
+	// Default 全局超时, 0不限制
+	Default time.Duration `yaml:"default"`
+	// Routes 按路由配置超时, 覆盖default, http为注册的路由如 /orders/:id, grpc为方法全名
+	Routes map[string]time.Duration `yaml:"routes"`
+	// Header 上游传递剩余超时时间的header, 默认X-Otz-Timeout, 值如 500ms 或毫秒数, 比配置的超时短时使用
+	Header string `yaml:"header"`
+}
+
+// header 上游超时header
+func (c *TimeoutConfig) header() string {
+	if c.Header == "" {
+		return DefaultTimeoutHeader
+	}
+	return c.Header
+}
+
+// parseTimeoutHeader 解析超时header, 支持 500ms/1s 及毫秒数
+func parseTimeoutHeader(value string) (time.Duration, bool) {
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(ms) * time.Millisecond, true
+	}
+	d, err := time.ParseDuration(value)
+	return d, err == nil
+}
+
+// requestTimeout 请求的超时时间, 0不限制, 上游传递的时间已耗尽时返回false
+func requestTimeout(c *TimeoutConfig, route string, header func(key string) string) (time.Duration, bool) {
+	timeout := c.Default
+	if t, ok := c.Routes[route]; ok {
+		timeout = t
+	}
+	if d, ok := parseTimeoutHeader(header(c.header())); ok {
+		if d <= 0 {
+			return 0, false
+		}
+		if timeout == 0 || d < timeout {
+			timeout = d
+		}
+	}
+	return timeout, true
+}
+
+// SetTimeoutHeader 将ctx的剩余超时时间写入请求头, 使用当前Server配置的header, 用于调用下游http服务
+// 下游为otz服务时按该时间设置超时, grpc调用由grpc自动传递deadline
+func (s *Server) SetTimeoutHeader(ctx context.Context, header http.Header) {
+	if deadline, ok := ctx.Deadline(); ok {
+		header.Set(s.currentConfig().Server.Timeout.header(), strconv.FormatInt(time.Until(deadline).Milliseconds(), 10))
+	}
+}
+
+// timeoutError 按ctx的结束原因转换错误, ctx未结束或处理函数返回了errs.Error时返回原错误
+// 超时为errs.CodeTimeout, 客户端断开为errs.CodeCanceled
+func timeoutError(ctx context.Context, err error) error {
+	var e *errs.Error
+	if ctx.Err() == nil || errors.As(err, &e) {
+		return err
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errs.New(errs.CodeTimeout, "request timeout")
+	}
+	return errs.New(errs.CodeCanceled, "request canceled")
+}
+
+// callHTTPHandler 按路由超时执行http处理函数, 超时且未写响应时返回超时错误
+func (svc *Service) callHTTPHandler(ctx context.Context, handler func(ctx context.Context)) {
+	otzCtx := otzctx.OTZContext(ctx)
+	ginCtx := otzCtx.GetGinCtx()
+	timeout, ok := requestTimeout(&svc.server.currentConfig().Server.Timeout, ginCtx.FullPath(), ginCtx.GetHeader)
+	if !ok {
+		// 上游已超时, 不再处理
+		otzCtx.SetError(errs.New(errs.CodeTimeout, "request timeout"))
+		writeErrorRsp(ginCtx, otzCtx.GetError())
+		return
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	handler(ctx)
+	if ctx.Err() == nil || (ginCtx.Writer.Written() && otzCtx.GetError() == nil) {
+		return
+	}
+	otzCtx.SetError(timeoutError(ctx, otzCtx.GetError()))
+	if errs.Code(otzCtx.GetError()) == errs.CodeTimeout && !ginCtx.Writer.Written() {
+		writeErrorRsp(ginCtx, otzCtx.GetError())
+	}
+}
+
+// callGRPCHandler 按方法超时执行grpc处理函数, 超时后处理函数返回的错误转换为超时错误
+func (svc *Service) callGRPCHandler(ctx context.Context, handler func(ctx context.Context) error) error {
+	req := otzctx.OTZContext(ctx).GetRequest()
+	timeout, ok := requestTimeout(&svc.server.currentConfig().Server.Timeout, req.Route, req.GetHeader)
+	if !ok {
+		return errs.New(errs.CodeTimeout, "request timeout")
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	err := handler(ctx)
+	if err == nil {
+		return nil
+	}
+	return timeoutError(ctx, err)
+}
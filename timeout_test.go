@@ -0,0 +1,165 @@
+package otz
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ShadowsGtt/otz/errs"
+	"github.com/ShadowsGtt/otz/log/logtest"
+	"github.com/ShadowsGtt/otz/otzctx"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimeout(t *testing.T) {
+	cfg, err := ParseConfig("otz_go.yaml", []byte(`server:
+  ip: 127.0.0.1
+  port: 8080
+  timeout:
+    default: 50ms
+    routes:
+      /fast: 10ms
+      /stream: 0s
+      /cancel: 0s
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(WithConfig(cfg), WithLogger(logtest.New()), WithListener(ln))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 同一进程中后创建的Server不影响s的超时配置
+	otherCfg, err := ParseConfig("otz_go.yaml", []byte("server:\n  ip: 127.0.0.1\n  port: 8080\n  timeout:\n    header: X-Other-Timeout\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = New(WithConfig(otherCfg), WithLogger(logtest.New())); err != nil {
+		t.Fatal(err)
+	}
+	deadlines := make(chan time.Duration, 1)
+	wait := func(ctx context.Context) {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			deadlines <- 0
+		} else {
+			deadlines <- time.Until(deadline)
+		}
+		<-ctx.Done()
+	}
+	s.Register("/slow", wait)
+	s.Register("/fast", wait)
+	s.Register("/stream", func(ctx context.Context) {
+		_, ok := ctx.Deadline()
+		if !ok {
+			deadlines <- 0
+		}
+		otzctx.OTZContext(ctx).GetGinCtx().String(http.StatusOK, "ok")
+	})
+
+	call := func(path, timeoutHeader string) (int, time.Duration) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if timeoutHeader != "" {
+			req.Header.Set(DefaultTimeoutHeader, timeoutHeader)
+		}
+		w := httptest.NewRecorder()
+		s.services[0].engine.ServeHTTP(w, req)
+		rsp := struct {
+			Code int `json:"code"`
+		}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+			t.Fatalf("unexpected body %s", w.Body.String())
+		}
+		select {
+		case d := <-deadlines:
+			return rsp.Code, d
+		default:
+			return rsp.Code, -1
+		}
+	}
+	if code, d := call("/slow", ""); code != errs.CodeTimeout || d <= 10*time.Millisecond || d > 50*time.Millisecond {
+		t.Fatalf("global timeout should be applied, code %d, deadline %s", code, d)
+	}
+	if code, d := call("/fast", ""); code != errs.CodeTimeout || d > 10*time.Millisecond {
+		t.Fatalf("route timeout should override global timeout, code %d, deadline %s", code, d)
+	}
+	// 上游传递的剩余时间更短时使用上游的
+	if code, d := call("/slow", "20ms"); code != errs.CodeTimeout || d > 20*time.Millisecond {
+		t.Fatalf("upstream timeout should be honored, code %d, deadline %s", code, d)
+	}
+	if code, d := call("/fast", "1000"); code != errs.CodeTimeout || d > 10*time.Millisecond {
+		t.Fatalf("longer upstream timeout should be ignored, code %d, deadline %s", code, d)
+	}
+	// 上游已超时时不执行处理函数
+	if code, d := call("/slow", "0"); code != errs.CodeTimeout || d != -1 {
+		t.Fatalf("handler should not be called, code %d, deadline %s", code, d)
+	}
+	w := httptest.NewRecorder()
+	s.services[0].engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stream", nil))
+	if w.Body.String() != "ok" || len(deadlines) != 1 {
+		t.Fatalf("route timeout 0 should disable timeout, got %s", w.Body.String())
+	}
+	<-deadlines
+
+	// 客户端断开时取消处理函数的ctx
+	canceled := make(chan error, 1)
+	s.Register("/cancel", func(ctx context.Context) {
+		select {
+		case <-ctx.Done():
+			canceled <- ctx.Err()
+		case <-time.After(time.Second):
+			canceled <- nil
+		}
+	})
+	go func() {
+		_ = s.Start()
+	}()
+	defer s.Shutdown(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+ln.Addr().String()+"/cancel", nil)
+	if _, err = http.DefaultClient.Do(req); err == nil {
+		t.Fatal("request should be canceled")
+	}
+	if err = <-canceled; err != context.Canceled {
+		t.Fatalf("handler ctx should be canceled by client disconnect, got %v", err)
+	}
+
+	header := http.Header{}
+	s.SetTimeoutHeader(context.Background(), header)
+	if len(header) != 0 {
+		t.Fatal("ctx without deadline should not set header")
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s.SetTimeoutHeader(ctx, header)
+	if d, ok := parseTimeoutHeader(header.Get(DefaultTimeoutHeader)); !ok || d <= 900*time.Millisecond || d > time.Second {
+		t.Fatalf("unexpected timeout header %v", header)
+	}
+}
+
+func TestTimeoutError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+	err := timeoutError(ctx, context.DeadlineExceeded)
+	if errs.Code(err) != errs.CodeTimeout || status.Code(GRPCError(err)) != codes.DeadlineExceeded {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err = timeoutError(ctx, errs.New(404, "not found")); errs.Code(err) != 404 {
+		t.Fatalf("errs.Error should be kept, got %v", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err = timeoutError(ctx, context.Canceled); errs.Code(err) != errs.CodeCanceled {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
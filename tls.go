@@ -0,0 +1,197 @@
+package otz
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/ShadowsGtt/otz/log"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	ClientAuthNone     = "none"     // 不要求客户端证书
+	ClientAuthOptional = "optional" // 客户端提供证书时校验
+	ClientAuthRequired = "required" // 必须提供并校验客户端证书
+
+	defaultCertReloadInterval = 10 * time.Second
+)
+
+// TLSConfig 服务TLS配置, cert_file为空时不开启
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// MinVersion 最低TLS版本 1.0/1.1/1.2/1.3, 默认1.2
+	MinVersion string `yaml:"min_version"`
+	// CipherSuites 加密套件名称, 如 TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, 为空使用go默认值, 对TLS1.3无效
+	CipherSuites []string `yaml:"cipher_suites"`
+	// ClientCA 校验客户端证书的CA文件, 设置后开启mTLS
+	ClientCA string `yaml:"client_ca"`
+	// ClientAuth 客户端证书校验方式 none/optional/required, 设置client_ca时默认required
+	ClientAuth string `yaml:"client_auth"`
+	// ReloadInterval 证书文件变化检查间隔, 默认10s, 新连接使用新证书
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+// Enabled 是否开启TLS
+func (c *TLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// baseTLSConfig 校验配置并生成不含证书的tls.Config
+func (c *TLSConfig) baseTLSConfig() (*tls.Config, error) {
+	if c.KeyFile == "" {
+		return nil, errors.New("key_file is required when cert_file is set")
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.MinVersion != "" {
+		version, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown min_version %q, must be one of 1.0, 1.1, 1.2, 1.3", c.MinVersion)
+		}
+		cfg.MinVersion = version
+	}
+	if len(c.CipherSuites) > 0 {
+		suites := map[string]uint16{}
+		for _, s := range tls.CipherSuites() {
+			suites[s.Name] = s.ID
+		}
+		for _, name := range c.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure cipher suite %s", name)
+			}
+			cfg.CipherSuites = append(cfg.CipherSuites, id)
+		}
+	}
+	clientAuth := c.ClientAuth
+	if clientAuth == "" && c.ClientCA != "" {
+		clientAuth = ClientAuthRequired
+	}
+	switch clientAuth {
+	case "", ClientAuthNone:
+		cfg.ClientAuth = tls.NoClientCert
+	case ClientAuthOptional:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequired:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client_auth %q, must be one of none, optional, required", c.ClientAuth)
+	}
+	if cfg.ClientAuth != tls.NoClientCert && c.ClientCA == "" {
+		return nil, fmt.Errorf("client_ca is required when client_auth is %s", clientAuth)
+	}
+	return cfg, nil
+}
+
+// certReloader 证书文件变化后重新加载, 在握手时按间隔检查, 不需要额外的协程
+type certReloader struct {
+	cfg       TLSConfig
+	base      *tls.Config
+	mutex     sync.Mutex
+	current   *tls.Config
+	modTimes  []time.Time
+	lastCheck time.Time
+}
+
+// newTLSConfig 创建支持证书热加载的tls.Config, nextProtos为ALPN协商的协议
+func newTLSConfig(c TLSConfig, nextProtos []string) (*tls.Config, error) {
+	base, err := c.baseTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	base.NextProtos = nextProtos
+	if c.ReloadInterval <= 0 {
+		c.ReloadInterval = defaultCertReloadInterval
+	}
+	r := &certReloader{cfg: c, base: base}
+	if err = r.load(); err != nil {
+		return nil, err
+	}
+	cfg := base.Clone()
+	cfg.GetConfigForClient = r.getConfigForClient
+	return cfg, nil
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCA != "" {
+		files = append(files, r.cfg.ClientCA)
+	}
+	return files
+}
+
+// load 加载证书及客户端CA
+func (r *certReloader) load() error {
+	modTimes := make([]time.Time, 0, 3)
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate failed: %v", err)
+	}
+	cfg := r.base.Clone()
+	cfg.Certificates = []tls.Certificate{cert}
+	if r.cfg.ClientCA != "" {
+		pem, err := ioutil.ReadFile(r.cfg.ClientCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no valid certificate in client_ca %s", r.cfg.ClientCA)
+		}
+		cfg.ClientCAs = pool
+	}
+	r.current = cfg
+	r.modTimes = modTimes
+	r.lastCheck = time.Now()
+	return nil
+}
+
+// changed 证书文件是否有变化
+func (r *certReloader) changed() bool {
+	for i, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return false
+		}
+		if !info.ModTime().Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *certReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if time.Since(r.lastCheck) < r.cfg.ReloadInterval {
+		return r.current, nil
+	}
+	r.lastCheck = time.Now()
+	if r.changed() {
+		// 加载失败(如证书和私钥只更新了一个)时继续使用旧证书, 下次检查重试
+		if err := r.load(); err != nil {
+			log.Errorf("reload certificate %s failed, keep current certificate, err: %v", r.cfg.CertFile, err)
+		} else {
+			log.Infof("reload certificate %s success", r.cfg.CertFile)
+		}
+	}
+	return r.current, nil
+}
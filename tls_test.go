@@ -0,0 +1,188 @@
+package otz
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/ShadowsGtt/otz/log/logtest"
+	"github.com/ShadowsGtt/otz/otzctx"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newTestCert 生成证书, parent为nil时生成自签名CA
+func newTestCert(t *testing.T, dir, name string, parent *testCert, serial int64) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, name+".crt"),
+		keyFile:  filepath.Join(dir, name+".key"),
+	}
+	writeConfig(t, c.certFile, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	writeConfig(t, c.keyFile, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})))
+	return c
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil, 1)
+	server := newTestCert(t, dir, "server", ca, 2)
+	client := newTestCert(t, dir, "client", ca, 3)
+
+	cfg, err := ParseConfig("otz_go.yaml", []byte(`server:
+  ip: 127.0.0.1
+  tls:
+    cert_file: `+server.certFile+`
+    key_file: `+server.keyFile+`
+    min_version: "1.2"
+    client_ca: `+ca.certFile+`
+    client_auth: required
+    reload_interval: 10ms
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(WithConfig(cfg), WithLogger(logtest.New()), WithListener(ln))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Register("/peer", func(ctx context.Context) {
+		peer := otzctx.OTZContext(ctx).GetPeer()
+		otzctx.OTZContext(ctx).GetGinCtx().String(http.StatusOK, peer.CommonName)
+	})
+	go func() {
+		_ = s.Start()
+	}()
+	defer s.Shutdown(context.Background())
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	clientCert, err := tls.LoadX509KeyPair(client.certFile, client.keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "https://" + ln.Addr().String() + "/peer"
+	get := func(certs []tls.Certificate) (*http.Response, error) {
+		c := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certs},
+			ForceAttemptHTTP2: true,
+		}}
+		return c.Get(url)
+	}
+	var rsp *http.Response
+	for i := 0; i < 50; i++ {
+		if rsp, err = get([]tls.Certificate{clientCert}); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if string(body) != "client" {
+		t.Fatalf("expect peer client, got %s", body)
+	}
+	if rsp.ProtoMajor != 2 {
+		t.Fatalf("expect http/2 negotiated by alpn, got %s", rsp.Proto)
+	}
+	if rsp.TLS.PeerCertificates[0].SerialNumber.Int64() != 2 {
+		t.Fatal("unexpected server certificate")
+	}
+	if _, err = get(nil); err == nil {
+		t.Fatal("request without client certificate should fail")
+	}
+
+	// 证书轮换, 新连接使用新证书
+	rotated := newTestCert(t, dir, "rotated", ca, 4)
+	future := time.Now().Add(time.Second)
+	for _, f := range [][2]string{{rotated.certFile, server.certFile}, {rotated.keyFile, server.keyFile}} {
+		if err = os.Rename(f[0], f[1]); err != nil {
+			t.Fatal(err)
+		}
+		_ = os.Chtimes(f[1], future, future)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if rsp, err = get([]tls.Certificate{clientCert}); err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if serial := rsp.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 4 {
+		t.Fatalf("certificate should be reloaded, got serial %d", serial)
+	}
+}
+
+func TestTLSConfigValidate(t *testing.T) {
+	_, err := ParseConfig("otz_go.yaml", []byte(`server:
+  tls:
+    cert_file: server.crt
+    key_file: server.key
+    min_version: "1.4"
+`))
+	if err == nil || !strings.Contains(err.Error(), "otz_go.yaml:3:5: server.tls: unknown min_version") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = ParseConfig("otz_go.yaml", []byte(`server:
+  tls:
+    cert_file: server.crt
+    key_file: server.key
+    client_auth: optional
+`))
+	if err == nil || !strings.Contains(err.Error(), "client_ca is required") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
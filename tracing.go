@@ -0,0 +1,350 @@
+package otz
+
+import (
+	"context"
+	"fmt"
+	"github.com/ShadowsGtt/otz/errs"
+	"github.com/ShadowsGtt/otz/log"
+	"github.com/ShadowsGtt/otz/otzctx"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// tracerName 框架创建span使用的instrumentation名称
+	tracerName = "github.com/ShadowsGtt/otz"
+
+	TracingExporterOTLP = "otlp"
+)
+
+var (
+	// propagator 框架使用的W3C trace context及baggage传递方式, 不依赖全局设置
+	propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+	// 未设置时otel的全局TracerProvider及propagator, 用于判断是否已被设置
+	defaultTracerProvider = otel.GetTracerProvider()
+	defaultPropagator     = otel.GetTextMapPropagator()
+	globalTracingMutex    sync.Mutex
+)
+
+// TracingConfig 链路追踪配置, exporter为空时不开启, 不支持热加载
+// 开启后每个请求创建一个server span, 从请求头中提取W3C traceparent作为父span, XxxCtx日志自动追加trace_id及span_id
+// 进程中还没有设置otel全局TracerProvider时, 第一个开启链路追踪的Server将自己的TracerProvider设置为全局的
+type TracingConfig struct {
+	// Exporter 导出方式, otlp为OTLP/HTTP, 为空不开启
+	Exporter string `yaml:"exporter"`
+	// Endpoint collector地址 host:port, 默认localhost:4318
+	Endpoint string `yaml:"endpoint"`
+	// URLPath 上报路径, 默认/v1/traces
+	URLPath string `yaml:"url_path"`
+	// Insecure 使用http上报, 默认https
+	Insecure bool `yaml:"insecure"`
+	// Headers 上报时携带的请求头, 如鉴权信息
+	Headers map[string]Secret `yaml:"headers"`
+	// Timeout 上报超时, 默认10s
+	Timeout time.Duration `yaml:"timeout"`
+	// SampleRatio 采样比例 0~1, 默认1, 上游已决定是否采样的请求跟随上游
+	SampleRatio float64 `yaml:"sample_ratio"`
+	// ServiceName 上报的服务名称, 默认为可执行文件名
+	ServiceName string `yaml:"service_name"`
+}
+
+// Enabled 是否开启链路追踪
+func (c *TracingConfig) Enabled() bool {
+	return c.Exporter != ""
+}
+
+// NewMemoryExporter 内存exporter, 配合WithSpanExporter在测试中检查上报的span
+func NewMemoryExporter() *tracetest.InMemoryExporter {
+	return tracetest.NewInMemoryExporter()
+}
+
+// setupTracing 按配置或WithSpanExporter创建TracerProvider, 全局TracerProvider未设置时设置为全局的
+func (s *Server) setupTracing() error {
+	c := s.cfg.Tracing
+	var processor sdktrace.SpanProcessor
+	if s.opts.spanExporter != nil {
+		// 同步导出, span结束后即可在exporter中获取
+		processor = sdktrace.NewSimpleSpanProcessor(s.opts.spanExporter)
+	} else if c.Enabled() {
+		opts := []otlptracehttp.Option{}
+		if c.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(c.Endpoint))
+		}
+		if c.URLPath != "" {
+			opts = append(opts, otlptracehttp.WithURLPath(c.URLPath))
+		}
+		if c.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		if len(c.Headers) > 0 {
+			headers := make(map[string]string, len(c.Headers))
+			for k, v := range c.Headers {
+				headers[k] = v.Value()
+			}
+			opts = append(opts, otlptracehttp.WithHeaders(headers))
+		}
+		if c.Timeout > 0 {
+			opts = append(opts, otlptracehttp.WithTimeout(c.Timeout))
+		}
+		exporter, err := otlptracehttp.New(context.Background(), opts...)
+		if err != nil {
+			return fmt.Errorf("create otlp exporter failed, err: %v", err)
+		}
+		processor = sdktrace.NewBatchSpanProcessor(exporter)
+	} else {
+		return nil
+	}
+	serviceName := c.ServiceName
+	if serviceName == "" {
+		serviceName = filepath.Base(os.Args[0])
+	}
+	ratio := c.SampleRatio
+	if ratio == 0 {
+		ratio = 1
+	}
+	res, err := resource.Merge(resource.Default(),
+		resource.NewSchemaless(attribute.String("service.name", serviceName)))
+	if err != nil {
+		return fmt.Errorf("create tracing resource failed, err: %v", err)
+	}
+	s.tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	s.tracer = s.tracerProvider.Tracer(tracerName)
+	setGlobalTracing(s.tracerProvider)
+	return nil
+}
+
+// setGlobalTracing 全局TracerProvider及propagator未设置时设置, 使用otel API的第三方库也能上报
+// 已由业务或其他Server设置时不替换
+func setGlobalTracing(tp trace.TracerProvider) {
+	globalTracingMutex.Lock()
+	defer globalTracingMutex.Unlock()
+	if otel.GetTracerProvider() == defaultTracerProvider {
+		otel.SetTracerProvider(tp)
+	}
+	if otel.GetTextMapPropagator() == defaultPropagator {
+		otel.SetTextMapPropagator(propagator)
+	}
+}
+
+// shutdownTracing 上报剩余的span并停止TracerProvider
+func (s *Server) shutdownTracing(ctx context.Context) error {
+	if s.tracerProvider == nil {
+		return nil
+	}
+	return s.tracerProvider.Shutdown(ctx)
+}
+
+// headerFuncCarrier 从otzctx.Request读取请求头的carrier, 只用于提取
+type headerFuncCarrier func(key string) string
+
+func (c headerFuncCarrier) Get(key string) string { return c(key) }
+func (c headerFuncCarrier) Set(string, string)    {}
+func (c headerFuncCarrier) Keys() []string        { return nil }
+
+// traceRequest 为请求创建server span并存入otz ctx, 请求结束时记录状态码及errs错误码
+func (s *Server) traceRequest(ctx context.Context, next HandlerFunc) {
+	otzCtx := otzctx.OTZContext(ctx)
+	var (
+		carrier propagation.TextMapCarrier
+		name    string
+		attrs   []attribute.KeyValue
+	)
+	ginCtx := otzCtx.GetGinCtx()
+	if ginCtx != nil {
+		carrier = propagation.HeaderCarrier(ginCtx.Request.Header)
+		name = ginCtx.Request.Method + " " + ginCtx.FullPath()
+		attrs = []attribute.KeyValue{
+			attribute.String("http.method", ginCtx.Request.Method),
+			attribute.String("http.route", ginCtx.FullPath()),
+			attribute.String("http.target", ginCtx.Request.URL.Path),
+			attribute.String("net.sock.peer.addr", ginCtx.ClientIP()),
+		}
+	} else {
+		req := otzCtx.GetRequest()
+		carrier = headerFuncCarrier(req.GetHeader)
+		name = req.Route
+		attrs = []attribute.KeyValue{
+			attribute.String("rpc.system", "grpc"),
+			attribute.String("rpc.method", req.Route),
+			attribute.String("net.sock.peer.addr", req.ClientIP),
+		}
+	}
+	ctx = propagator.Extract(ctx, carrier)
+	ctx, span := s.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+	// 请求结束后仍保留在otz ctx中, 访问日志可以输出trace_id
+	log.WithSpanCtx(otzCtx.Context(), span)
+	defer func() {
+		err := otzCtx.GetError()
+		span.SetAttributes(attribute.Int("otz.errs_code", errs.Code(err)))
+		// 错误通过errs错误码返回, http状态码可能为200, 设置了错误即为失败
+		failed := err != nil
+		if ginCtx != nil {
+			code := ginCtx.Writer.Status()
+			span.SetAttributes(attribute.Int("http.status_code", code))
+			failed = failed || code >= http.StatusInternalServerError
+		} else {
+			span.SetAttributes(attribute.Int("rpc.grpc.status_code", int(status.Code(GRPCError(err)))))
+		}
+		if err != nil {
+			span.RecordError(err)
+		}
+		if failed {
+			span.SetStatus(otelcodes.Error, errs.Msg(err))
+		}
+		span.End()
+	}()
+	next(ctx)
+}
+
+// requestSpanContext ctx中没有span时使用otz ctx中请求的span, 以便直接传入otzCtx.Context()
+func requestSpanContext(ctx context.Context) context.Context {
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+	if span := otzctx.OTZContext(ctx).GetSpan(); span != nil {
+		return trace.ContextWithSpan(ctx, span)
+	}
+	return ctx
+}
+
+// clientTracer 使用ctx中请求span所属的TracerProvider, 同一进程中的多个Server各自上报, 没有span时使用全局的
+func clientTracer(ctx context.Context) trace.Tracer {
+	if span := trace.SpanFromContext(ctx); span.SpanContext().IsValid() {
+		return span.TracerProvider().Tracer(tracerName)
+	}
+	return otel.Tracer(tracerName)
+}
+
+// InjectTraceHeader 将ctx中的链路信息写入请求头, 用于自行发起的http请求
+func InjectTraceHeader(ctx context.Context, header http.Header) {
+	propagator.Inject(requestSpanContext(ctx), propagation.HeaderCarrier(header))
+}
+
+// tracingTransport 为请求创建client span并传递链路信息
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+// NewTracingTransport 包装http.RoundTripper, base为nil时使用http.DefaultTransport
+// 请求需通过req.WithContext携带请求的ctx
+func NewTracingTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &tracingTransport{base: base}
+}
+
+// RoundTrip 发起请求, 记录状态码
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := requestSpanContext(req.Context())
+	ctx, span := clientTracer(ctx).Start(ctx, "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.url", req.URL.Redacted()),
+		))
+	defer span.End()
+	req = req.Clone(ctx)
+	propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	rsp, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+		return rsp, err
+	}
+	span.SetAttributes(attribute.Int("http.status_code", rsp.StatusCode))
+	if rsp.StatusCode >= http.StatusBadRequest {
+		span.SetStatus(otelcodes.Error, strconv.Itoa(rsp.StatusCode))
+	}
+	return rsp, nil
+}
+
+// startGRPCClientSpan 创建grpc client span并将链路信息写入outgoing metadata
+func startGRPCClientSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	ctx = requestSpanContext(ctx)
+	ctx, span := clientTracer(ctx).Start(ctx, method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("rpc.system", "grpc"), attribute.String("rpc.method", method)))
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	propagator.Inject(ctx, metadataCarrier(md))
+	return metadata.NewOutgoingContext(ctx, md), span
+}
+
+// endGRPCClientSpan 记录grpc状态码并结束span
+func endGRPCClientSpan(span trace.Span, err error) {
+	code := status.Code(err)
+	span.SetAttributes(attribute.Int("rpc.grpc.status_code", int(code)))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, status.Convert(err).Message())
+	}
+	span.End()
+}
+
+// metadataCarrier 写入grpc metadata的carrier
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if values := metadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// UnaryClientTracing grpc客户端拦截器, 创建client span并传递链路信息
+// 使用 grpc.WithChainUnaryInterceptor(otz.UnaryClientTracing)
+func UnaryClientTracing(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	ctx, span := startGRPCClientSpan(ctx, method)
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	endGRPCClientSpan(span, err)
+	return err
+}
+
+// StreamClientTracing grpc流式客户端拦截器, span在创建stream后结束, 不包含消息收发
+// 使用 grpc.WithChainStreamInterceptor(otz.StreamClientTracing)
+func StreamClientTracing(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+	streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	ctx, span := startGRPCClientSpan(ctx, method)
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	endGRPCClientSpan(span, err)
+	return stream, err
+}
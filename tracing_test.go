@@ -0,0 +1,216 @@
+package otz
+
+import (
+	"context"
+	"github.com/ShadowsGtt/otz/errs"
+	"github.com/ShadowsGtt/otz/log"
+	"github.com/ShadowsGtt/otz/log/logtest"
+	"github.com/ShadowsGtt/otz/otzctx"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// spanAttr 获取span的属性值
+func spanAttr(span tracetest.SpanStub, key string) attribute.Value {
+	for _, kv := range span.Attributes {
+		if string(kv.Key) == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func findSpan(t *testing.T, spans tracetest.SpanStubs, name string, kind trace.SpanKind) tracetest.SpanStub {
+	for _, span := range spans {
+		if span.Name == name && span.SpanKind == kind {
+			return span
+		}
+	}
+	t.Fatalf("span %s not found in %d spans", name, len(spans))
+	return tracetest.SpanStub{}
+}
+
+func TestTracing(t *testing.T) {
+	cfg, err := ParseConfig("otz_go.yaml", []byte(`server:
+  services:
+    - name: web
+      address: 127.0.0.1:0
+    - name: rpc
+      type: grpc
+      address: 127.0.0.1:0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpcLn, _ := net.Listen("tcp", "127.0.0.1:0")
+	exporter := NewMemoryExporter()
+	recorder := logtest.New()
+	s, err := New(WithConfig(cfg), WithLogger(recorder), WithSpanExporter(exporter), WithServiceListener("rpc", rpcLn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpc_health_v1.RegisterHealthServer(s.Service("rpc"), &testHealthServer{})
+	go func() {
+		_ = s.Start()
+	}()
+	defer s.Shutdown(context.Background())
+
+	var downstreamHeader string
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downstreamHeader = r.Header.Get("traceparent")
+	}))
+	defer downstream.Close()
+	conn, err := grpc.Dial(rpcLn.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithChainUnaryInterceptor(UnaryClientTracing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := &http.Client{Transport: NewTracingTransport(nil)}
+
+	s.Register("/orders/:id", func(ctx context.Context) {
+		otzCtx := otzctx.OTZContext(ctx)
+		if otzCtx.GetGinCtx().Param("id") == "0" {
+			otzCtx.SetError(errs.New(500, "db error"))
+			otzCtx.GetGinCtx().String(http.StatusInternalServerError, "error")
+			return
+		}
+		log.InfoCtx(ctx, "query order")
+		// 使用otzCtx.Context()同样可以传递链路信息
+		req, _ := http.NewRequestWithContext(otzCtx.Context(), http.MethodGet, downstream.URL, nil)
+		rsp, err := client.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		rsp.Body.Close()
+		if _, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{},
+			grpc.WaitForReady(true)); err != nil {
+			t.Error(err)
+		}
+		otzCtx.GetGinCtx().String(http.StatusOK, "ok")
+	})
+
+	const (
+		traceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentID = "00f067aa0ba902b7"
+	)
+	req := httptest.NewRequest(http.MethodGet, "/orders/1", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	s.services[0].engine.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 4 {
+		t.Fatalf("expect 4 spans, got %d", len(spans))
+	}
+	for _, span := range spans {
+		if span.SpanContext.TraceID().String() != traceID {
+			t.Fatalf("span %s should continue incoming trace, got %s", span.Name, span.SpanContext.TraceID())
+		}
+	}
+	server := findSpan(t, spans, "GET /orders/:id", trace.SpanKindServer)
+	if server.Parent.SpanID().String() != parentID || spanAttr(server, "http.route").AsString() != "/orders/:id" ||
+		spanAttr(server, "http.status_code").AsInt64() != 200 || spanAttr(server, "otz.errs_code").AsInt64() != 0 {
+		t.Fatalf("unexpected server span %+v", server)
+	}
+	httpClient := findSpan(t, spans, "HTTP GET", trace.SpanKindClient)
+	if httpClient.Parent.SpanID() != server.SpanContext.SpanID() ||
+		!strings.Contains(downstreamHeader, httpClient.SpanContext.SpanID().String()) {
+		t.Fatalf("trace context should be injected into outgoing request, got %q", downstreamHeader)
+	}
+	grpcClient := findSpan(t, spans, "/grpc.health.v1.Health/Check", trace.SpanKindClient)
+	grpcServer := findSpan(t, spans, "/grpc.health.v1.Health/Check", trace.SpanKindServer)
+	if grpcServer.Parent.SpanID() != grpcClient.SpanContext.SpanID() || grpcClient.Parent.SpanID() != server.SpanContext.SpanID() ||
+		spanAttr(grpcServer, "rpc.method").AsString() != grpcClient.Name {
+		t.Fatalf("grpc server span should be child of client span, got %+v", grpcServer)
+	}
+
+	// 业务日志及访问日志带有请求span的trace_id和span_id
+	entries := recorder.All().FilterField(log.FieldSpanID, server.SpanContext.SpanID().String())
+	if entries.FilterMessage("query order").Len() != 1 || entries.FilterMessage("URI: /orders/1").Len() != 1 ||
+		entries[0].Fields[log.FieldTraceID] != traceID {
+		t.Fatalf("log should contain trace fields, got %v", recorder.All())
+	}
+
+	exporter.Reset()
+	s.services[0].engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/orders/0", nil))
+	spans = exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Parent.IsValid() || spans[0].Status.Code != otelcodes.Error ||
+		spanAttr(spans[0], "otz.errs_code").AsInt64() != 500 || spanAttr(spans[0], "http.status_code").AsInt64() != 500 {
+		t.Fatalf("unexpected error span %+v", spans)
+	}
+}
+
+func TestTracingMultiServer(t *testing.T) {
+	cfg, err := ParseConfig("otz_go.yaml", []byte("server:\n  ip: 127.0.0.1\n  port: 8080\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer downstream.Close()
+	client := &http.Client{Transport: NewTracingTransport(nil)}
+	newServer := func(exporter *tracetest.InMemoryExporter) *Server {
+		s, err := New(WithConfig(cfg), WithLogger(logtest.New()), WithSpanExporter(exporter))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Register("/call", func(ctx context.Context) {
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, downstream.URL, nil)
+			if rsp, err := client.Do(req); err == nil {
+				rsp.Body.Close()
+			}
+		})
+		s.Use(func(ctx context.Context, next HandlerFunc) {
+			otzCtx := otzctx.OTZContext(ctx)
+			if otzCtx.GetGinCtx().Query("token") == "" {
+				otzCtx.SetError(errs.New(401, "unauthorized"))
+				return
+			}
+			next(ctx)
+		})
+		return s
+	}
+	first, second := NewMemoryExporter(), NewMemoryExporter()
+	s1 := newServer(first)
+	global := otel.GetTracerProvider()
+	s2 := newServer(second)
+	if otel.GetTracerProvider() != global {
+		t.Fatal("global tracer provider should not be replaced by later server")
+	}
+
+	// 第一个Server关闭后, 第二个Server的请求及调用下游的span仍上报到自己的exporter
+	if err = s1.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s2.services[0].engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/call?token=1", nil))
+	spans := second.GetSpans()
+	if len(spans) != 2 || len(first.GetSpans()) != 0 {
+		t.Fatalf("spans should be exported by handling server, got %d and %d", len(spans), len(first.GetSpans()))
+	}
+	server := findSpan(t, spans, "GET /call", trace.SpanKindServer)
+	if findSpan(t, spans, "HTTP GET", trace.SpanKindClient).Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Fatalf("client span should be child of server span, got %+v", spans)
+	}
+
+	// 拦截器中断请求时span记录写入的错误响应
+	second.Reset()
+	w := httptest.NewRecorder()
+	s2.services[0].engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/call", nil))
+	spans = second.GetSpans()
+	if !strings.Contains(w.Body.String(), "unauthorized") || len(spans) != 1 || spans[0].Status.Code != otelcodes.Error ||
+		spanAttr(spans[0], "otz.errs_code").AsInt64() != 401 || spanAttr(spans[0], "http.status_code").AsInt64() != http.StatusOK {
+		t.Fatalf("unexpected abort span %+v, body %s", spans, w.Body.String())
+	}
+	_ = s2.Shutdown(context.Background())
+}
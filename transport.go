@@ -0,0 +1,166 @@
+package otz
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	ProtocolHTTP1 = "http1" // 只支持HTTP/1.1
+	ProtocolH2C   = "h2c"   // 明文同一端口同时支持HTTP/1.1及HTTP/2(h2c)
+)
+
+// TransportConfig 服务传输层配置, 对应http.Server的参数
+type TransportConfig struct {
+	// Protocol 协议 http1/h2c, 默认明文HTTP/1.1, TLS时通过ALPN协商HTTP/2, http1表示禁用HTTP/2
+	Protocol string `yaml:"protocol"`
+	// ReadTimeout 读取整个请求(含body)的超时时间, 0不限制
+	ReadTimeout time.Duration `yaml:"read_timeout"`
+	// ReadHeaderTimeout 读取请求头的超时时间, 0时使用ReadTimeout
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	// WriteTimeout 写响应的超时时间, 0不限制
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	// IdleTimeout keep-alive连接空闲超时时间, 0时使用ReadTimeout
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// MaxHeaderBytes 请求头最大字节数, 0使用默认值1MB
+	MaxHeaderBytes int `yaml:"max_header_bytes"`
+	// DisableKeepAlive 关闭HTTP/1.1 keep-alive, 每个请求后关闭连接
+	DisableKeepAlive bool `yaml:"disable_keep_alive"`
+}
+
+// validate 校验配置
+func (c *TransportConfig) validate() error {
+	switch c.Protocol {
+	case "", ProtocolHTTP1, ProtocolH2C:
+	default:
+		return fmt.Errorf("unknown protocol %q, must be one of http1, h2c", c.Protocol)
+	}
+	if c.ReadTimeout < 0 || c.ReadHeaderTimeout < 0 || c.WriteTimeout < 0 || c.IdleTimeout < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+	if c.MaxHeaderBytes < 0 {
+		return errors.New("max_header_bytes must not be negative")
+	}
+	return nil
+}
+
+// nextProtos TLS ALPN协商的协议
+func (c *TransportConfig) nextProtos() []string {
+	if c.Protocol == ProtocolHTTP1 {
+		return []string{"http/1.1"}
+	}
+	return []string{"h2", "http/1.1"}
+}
+
+// connCtxKey 请求ctx中保存连接的key
+type connCtxKey struct{}
+
+// newHTTPServer 按传输层配置创建http.Server
+// h2c连接被接管后http.Server不再跟踪, 记录在conns中, 停止时单独等待
+func newHTTPServer(c TransportConfig, handler http.Handler, tlsEnabled bool, conns *activeTracker) (*http.Server, error) {
+	srv := &http.Server{
+		ReadTimeout:       c.ReadTimeout,
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
+		MaxHeaderBytes:    c.MaxHeaderBytes,
+	}
+	srv.SetKeepAlivesEnabled(!c.DisableKeepAlive)
+	h2Server := &http2.Server{IdleTimeout: c.IdleTimeout}
+	switch {
+	case c.Protocol == ProtocolHTTP1:
+		// 非nil的空map禁用HTTP/2
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	case tlsEnabled:
+		// 自行创建tls listener, 需要手动注册h2
+		if err := http2.ConfigureServer(srv, h2Server); err != nil {
+			return nil, err
+		}
+	case c.Protocol == ProtocolH2C:
+		// 注册到srv, Shutdown时向h2c连接发送GOAWAY, 处理中的请求完成后关闭连接
+		if err := http2.ConfigureServer(srv, h2Server); err != nil {
+			return nil, err
+		}
+		srv.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, connCtxKey{}, conn)
+		}
+		handler = trackConns(h2c.NewHandler(handler, h2Server), conns)
+	}
+	srv.Handler = handler
+	return srv, nil
+}
+
+// trackConns 记录处理中的请求所在的连接, h2c连接在整个连接期间处于处理中
+func trackConns(handler http.Handler, conns *activeTracker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _ := r.Context().Value(connCtxKey{}).(net.Conn)
+		conns.add(conn)
+		defer conns.done(conn)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// activeTracker 跟踪处理中的请求及其连接, 用于等待http.Server不跟踪的请求结束
+type activeTracker struct {
+	mutex   sync.Mutex
+	conns   map[net.Conn]int // 连接及其处理中的请求数, 不需要连接时使用nil
+	changed chan struct{}    // 请求结束时关闭并替换
+}
+
+func newActiveTracker() *activeTracker {
+	return &activeTracker{conns: map[net.Conn]int{}, changed: make(chan struct{})}
+}
+
+// add 开始处理请求
+func (t *activeTracker) add(conn net.Conn) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.conns[conn]++
+}
+
+// done 请求处理完成
+func (t *activeTracker) done(conn net.Conn) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.conns[conn]--; t.conns[conn] <= 0 {
+		delete(t.conns, conn)
+	}
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// wait 等待所有请求处理完成, ctx结束时返回ctx的错误
+func (t *activeTracker) wait(ctx context.Context) error {
+	for {
+		t.mutex.Lock()
+		active, changed := len(t.conns), t.changed
+		t.mutex.Unlock()
+		if active == 0 {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// closeConns 强制关闭处理中请求所在的连接
+func (t *activeTracker) closeConns() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for conn := range t.conns {
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}
+}
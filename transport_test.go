@@ -0,0 +1,173 @@
+package otz
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/ShadowsGtt/otz/log/logtest"
+	"github.com/ShadowsGtt/otz/otzctx"
+	"golang.org/x/net/http2"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestH2C(t *testing.T) {
+	cfg, err := ParseConfig("otz_go.yaml", []byte(`server:
+  transport:
+    protocol: h2c
+    read_header_timeout: 2s
+    idle_timeout: 30s
+    max_header_bytes: 65536
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(WithConfig(cfg), WithLogger(logtest.New()), WithListener(ln))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Register("/proto", func(ctx context.Context) {
+		c := otzctx.OTZContext(ctx).GetGinCtx()
+		c.String(http.StatusOK, c.Request.Proto)
+	})
+	go func() {
+		_ = s.Start()
+	}()
+	defer s.Shutdown(context.Background())
+	for i := 0; i < 50 && s.Service(defaultServiceName).Addr() == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	srv := s.services[0].httpServer
+	if srv.ReadHeaderTimeout != 2*time.Second || srv.IdleTimeout != 30*time.Second || srv.MaxHeaderBytes != 65536 {
+		t.Fatalf("transport config not applied: %+v", srv)
+	}
+
+	url := "http://" + ln.Addr().String() + "/proto"
+	h2cClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	for _, c := range []struct {
+		client *http.Client
+		proto  string
+	}{{h2cClient, "HTTP/2.0"}, {http.DefaultClient, "HTTP/1.1"}} {
+		rsp, err := c.client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if string(body) != c.proto {
+			t.Fatalf("expect %s, got %s", c.proto, body)
+		}
+	}
+
+	_, err = ParseConfig("otz_go.yaml", []byte("server:\n  transport:\n    protocol: h3\n"))
+	if err == nil || !strings.Contains(err.Error(), "server.transport: unknown protocol \"h3\"") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestH2CShutdown(t *testing.T) {
+	cfg, err := ParseConfig("otz_go.yaml", []byte("server:\n  ip: 127.0.0.1\n  port: 8080\n  transport:\n    protocol: h2c\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2cClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	// start 启动h2c服务并发起一个处理中的请求, 返回请求结果
+	start := func(release chan struct{}) (*Server, chan string) {
+		ln, _ := net.Listen("tcp", "127.0.0.1:0")
+		s, err := New(WithConfig(cfg), WithLogger(logtest.New()), WithListener(ln))
+		if err != nil {
+			t.Fatal(err)
+		}
+		started := make(chan struct{})
+		s.Register("/slow", func(ctx context.Context) {
+			close(started)
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return
+			}
+			otzctx.OTZContext(ctx).GetGinCtx().String(http.StatusOK, "ok")
+		})
+		go func() {
+			_ = s.Start()
+		}()
+		result := make(chan string, 1)
+		go func() {
+			for i := 0; i < 50 && s.Service(defaultServiceName).Addr() == nil; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			rsp, err := h2cClient.Get("http://" + ln.Addr().String() + "/slow")
+			if err != nil {
+				result <- err.Error()
+				return
+			}
+			body, _ := ioutil.ReadAll(rsp.Body)
+			rsp.Body.Close()
+			result <- string(body)
+		}()
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("request not started")
+		}
+		return s, result
+	}
+
+	// 停止时等待处理中的h2c请求完成
+	release := make(chan struct{})
+	s, result := start(release)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+	select {
+	case err = <-done:
+		t.Fatalf("shutdown should wait for in-flight h2c request, got %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(release)
+	if body := <-result; body != "ok" {
+		t.Fatalf("in-flight h2c request should complete, got %s", body)
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown should return after request completed")
+	}
+
+	// 超时后强制关闭h2c连接
+	s, result = start(make(chan struct{}))
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err = s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown should time out, got %v", err)
+	}
+	select {
+	case body := <-result:
+		if body == "ok" {
+			t.Fatal("request should be cut off after shutdown timeout")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("h2c connection should be closed after shutdown timeout")
+	}
+}
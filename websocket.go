@@ -0,0 +1,487 @@
+package otz
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/ShadowsGtt/otz/errs"
+	"github.com/ShadowsGtt/otz/log"
+	"github.com/ShadowsGtt/otz/otzctx"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// WebSocket消息类型
+const (
+	TextMessage   = websocket.TextMessage
+	BinaryMessage = websocket.BinaryMessage
+)
+
+const (
+	defaultWSReadTimeout    = 60 * time.Second
+	defaultWSWriteTimeout   = 10 * time.Second
+	defaultWSMaxMessageSize = 1 << 20
+	defaultWSSendQueueSize  = 64
+)
+
+// ErrWebSocketClosed 连接已关闭
+var ErrWebSocketClosed = errors.New("websocket connection closed")
+
+// WebSocketHandler 处理一个WebSocket连接, 返回时关闭连接
+type WebSocketHandler func(conn *WebSocketConn)
+
+// WebSocketOption WebSocket接口选项
+type WebSocketOption func(o *webSocketOptions)
+
+type webSocketOptions struct {
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	pingInterval   time.Duration
+	maxMessageSize int64
+	sendQueueSize  int
+	upgrader       websocket.Upgrader
+}
+
+// WithWSReadTimeout 读超时, 超时未收到消息或pong时关闭连接, 默认60s
+func WithWSReadTimeout(d time.Duration) WebSocketOption {
+	return func(o *webSocketOptions) {
+		o.readTimeout = d
+	}
+}
+
+// WithWSWriteTimeout 单条消息写超时, 默认10s
+func WithWSWriteTimeout(d time.Duration) WebSocketOption {
+	return func(o *webSocketOptions) {
+		o.writeTimeout = d
+	}
+}
+
+// WithWSPingInterval 发送ping的间隔, 默认为读超时的9/10
+func WithWSPingInterval(d time.Duration) WebSocketOption {
+	return func(o *webSocketOptions) {
+		o.pingInterval = d
+	}
+}
+
+// WithWSMaxMessageSize 接收消息的最大字节数, 超过时以1009关闭连接, 默认1MB
+func WithWSMaxMessageSize(n int64) WebSocketOption {
+	return func(o *webSocketOptions) {
+		o.maxMessageSize = n
+	}
+}
+
+// WithWSSendQueueSize 发送队列长度, 广播时队列已满的慢连接会被关闭, 默认64
+func WithWSSendQueueSize(n int) WebSocketOption {
+	return func(o *webSocketOptions) {
+		o.sendQueueSize = n
+	}
+}
+
+// WithWSCheckOrigin 校验请求来源, 默认只允许与Host相同的Origin
+func WithWSCheckOrigin(check func(r *http.Request) bool) WebSocketOption {
+	return func(o *webSocketOptions) {
+		o.upgrader.CheckOrigin = check
+	}
+}
+
+// WithWSSubprotocols 服务端支持的子协议, 按顺序与客户端协商
+func WithWSSubprotocols(protocols ...string) WebSocketOption {
+	return func(o *webSocketOptions) {
+		o.upgrader.Subprotocols = protocols
+	}
+}
+
+func newWebSocketOptions(opts []WebSocketOption) *webSocketOptions {
+	o := &webSocketOptions{
+		readTimeout:    defaultWSReadTimeout,
+		writeTimeout:   defaultWSWriteTimeout,
+		maxMessageSize: defaultWSMaxMessageSize,
+		sendQueueSize:  defaultWSSendQueueSize,
+	}
+	o.upgrader.HandshakeTimeout = defaultWSWriteTimeout
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.pingInterval <= 0 {
+		o.pingInterval = o.readTimeout * 9 / 10
+	}
+	return o
+}
+
+type wsMessage struct {
+	messageType int
+	data        []byte
+}
+
+// WebSocketConn 一个WebSocket连接
+// 读写分别由独立的协程完成, 可以在任意协程中调用Write及Close, 连接关闭时Context被取消
+type WebSocketConn struct {
+	conn   *websocket.Conn
+	opts   *webSocketOptions
+	hub    *wsHub
+	ctx    context.Context
+	cancel context.CancelFunc
+	recv   chan wsMessage
+	send   chan wsMessage
+	groups map[string]bool // 由hub.mutex保护
+
+	closeOnce sync.Once
+	closeCode int
+	closeText string
+	err       error
+}
+
+// Context 连接的otz ctx, 携带请求级logger, 连接关闭时取消
+func (c *WebSocketConn) Context() context.Context {
+	return c.ctx
+}
+
+// RemoteAddr 客户端地址
+func (c *WebSocketConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Subprotocol 协商的子协议
+func (c *WebSocketConn) Subprotocol() string {
+	return c.conn.Subprotocol()
+}
+
+// ReadMessage 读取一条消息, 连接关闭时返回错误
+func (c *WebSocketConn) ReadMessage() (messageType int, data []byte, err error) {
+	select {
+	case msg := <-c.recv:
+		return msg.messageType, msg.data, nil
+	case <-c.ctx.Done():
+		return 0, nil, c.err
+	}
+}
+
+// ReadJSON 读取一条消息并解析json
+func (c *WebSocketConn) ReadJSON(v interface{}) error {
+	_, data, err := c.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// WriteMessage 发送一条消息, 发送队列满时阻塞, 连接关闭时返回ErrWebSocketClosed
+func (c *WebSocketConn) WriteMessage(messageType int, data []byte) error {
+	if c.ctx.Err() != nil {
+		return ErrWebSocketClosed
+	}
+	select {
+	case c.send <- wsMessage{messageType: messageType, data: data}:
+		return nil
+	case <-c.ctx.Done():
+		return ErrWebSocketClosed
+	}
+}
+
+// WriteJSON 以文本消息发送json
+func (c *WebSocketConn) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(TextMessage, data)
+}
+
+// Join 加入广播组
+func (c *WebSocketConn) Join(groups ...string) {
+	c.hub.join(c, groups)
+}
+
+// Leave 离开广播组
+func (c *WebSocketConn) Leave(groups ...string) {
+	c.hub.leave(c, groups)
+}
+
+// Close 以1000正常关闭连接
+func (c *WebSocketConn) Close() {
+	c.closeWith(websocket.CloseNormalClosure, "", ErrWebSocketClosed)
+}
+
+// closeWith 记录关闭原因并取消ctx, 由写协程发送close帧后关闭底层连接, 只有第一次调用生效
+func (c *WebSocketConn) closeWith(code int, text string, err error) {
+	c.closeOnce.Do(func() {
+		c.closeCode, c.closeText, c.err = code, text, err
+		c.cancel()
+	})
+}
+
+// readLoop 持续读取消息, 处理pong并刷新读超时, 读取失败时关闭连接
+func (c *WebSocketConn) readLoop() {
+	c.conn.SetReadLimit(c.opts.maxMessageSize)
+	_ = c.conn.SetReadDeadline(time.Now().Add(c.opts.readTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(c.opts.readTimeout))
+	})
+	for {
+		messageType, data, err := c.conn.ReadMessage()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			switch {
+			case errors.As(err, &closeErr):
+				// 客户端关闭, 回复相同的关闭码
+				c.closeWith(closeErr.Code, "", err)
+			case errors.Is(err, websocket.ErrReadLimit):
+				c.closeWith(websocket.CloseMessageTooBig, "message too big", err)
+			default:
+				c.closeWith(websocket.CloseGoingAway, "", err)
+			}
+			return
+		}
+		select {
+		case c.recv <- wsMessage{messageType: messageType, data: data}:
+		case <-c.ctx.Done():
+			return
+		}
+		// 处理函数读取消息后再刷新读超时, 处理慢不会导致超时
+		_ = c.conn.SetReadDeadline(time.Now().Add(c.opts.readTimeout))
+	}
+}
+
+// writeLoop 发送消息及ping, 连接关闭时发送close帧并关闭底层连接
+func (c *WebSocketConn) writeLoop() {
+	ticker := time.NewTicker(c.opts.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(c.opts.writeTimeout))
+			if err := c.conn.WriteMessage(msg.messageType, msg.data); err != nil {
+				c.closeWith(websocket.CloseGoingAway, "", err)
+			}
+		case <-ticker.C:
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.opts.writeTimeout))
+			if err != nil {
+				c.closeWith(websocket.CloseGoingAway, "", err)
+			}
+		case <-c.ctx.Done():
+			c.drain()
+			// 对端已断开时close帧发送失败, 忽略错误
+			_ = c.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(c.closeCode, c.closeText), time.Now().Add(c.opts.writeTimeout))
+			_ = c.conn.Close()
+			return
+		}
+	}
+}
+
+// drain 关闭前发送队列中剩余的消息, 写失败时放弃
+func (c *WebSocketConn) drain() {
+	for {
+		select {
+		case msg := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(c.opts.writeTimeout))
+			if err := c.conn.WriteMessage(msg.messageType, msg.data); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// wsHub 服务的WebSocket连接及广播组
+type wsHub struct {
+	mutex  sync.Mutex
+	conns  map[*WebSocketConn]struct{}
+	groups map[string]map[*WebSocketConn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newWSHub() *wsHub {
+	return &wsHub{
+		conns:  map[*WebSocketConn]struct{}{},
+		groups: map[string]map[*WebSocketConn]struct{}{},
+	}
+}
+
+// add 添加连接, 服务停止后返回false
+func (h *wsHub) add(c *WebSocketConn) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		return false
+	}
+	h.conns[c] = struct{}{}
+	h.wg.Add(1)
+	return true
+}
+
+func (h *wsHub) remove(c *WebSocketConn) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for group := range c.groups {
+		h.removeFromGroup(c, group)
+	}
+	delete(h.conns, c)
+	h.wg.Done()
+}
+
+func (h *wsHub) join(c *WebSocketConn, groups []string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, ok := h.conns[c]; !ok {
+		return
+	}
+	for _, group := range groups {
+		members, ok := h.groups[group]
+		if !ok {
+			members = map[*WebSocketConn]struct{}{}
+			h.groups[group] = members
+		}
+		members[c] = struct{}{}
+		c.groups[group] = true
+	}
+}
+
+func (h *wsHub) leave(c *WebSocketConn, groups []string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, group := range groups {
+		h.removeFromGroup(c, group)
+	}
+}
+
+func (h *wsHub) removeFromGroup(c *WebSocketConn, group string) {
+	delete(c.groups, group)
+	if members, ok := h.groups[group]; ok {
+		delete(members, c)
+		if len(members) == 0 {
+			delete(h.groups, group)
+		}
+	}
+}
+
+// broadcast 向组内所有连接发送消息, 不阻塞, 发送队列已满的连接以1013关闭, 返回成功入队的连接数
+func (h *wsHub) broadcast(group string, messageType int, data []byte) int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	n := 0
+	for c := range h.groups[group] {
+		if c.ctx.Err() != nil {
+			continue
+		}
+		select {
+		case c.send <- wsMessage{messageType: messageType, data: data}:
+			n++
+		default:
+			log.WarnCtxf(c.ctx, "websocket send queue full, close slow connection %s", c.RemoteAddr())
+			c.closeWith(websocket.CloseTryAgainLater, "send queue full", ErrWebSocketClosed)
+		}
+	}
+	return n
+}
+
+// shutdown 拒绝新连接, 以1001关闭所有连接并等待处理函数返回
+func (h *wsHub) shutdown(ctx context.Context) error {
+	h.mutex.Lock()
+	h.closed = true
+	for c := range h.conns {
+		c.closeWith(websocket.CloseGoingAway, "server shutting down", ErrWebSocketClosed)
+	}
+	h.mutex.Unlock()
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RegisterWebSocket 在默认服务上注册WebSocket接口
+func (s *Server) RegisterWebSocket(path string, handler WebSocketHandler, opts ...WebSocketOption) {
+	s.services[0].RegisterWebSocket(path, handler, opts...)
+}
+
+// Broadcast 向所有服务中加入group的WebSocket连接发送消息, 返回成功入队的连接数
+func (s *Server) Broadcast(group string, messageType int, data []byte) int {
+	n := 0
+	for _, svc := range s.services {
+		n += svc.Broadcast(group, messageType, data)
+	}
+	return n
+}
+
+// Broadcast 向服务中加入group的WebSocket连接发送消息, 返回成功入队的连接数
+func (svc *Service) Broadcast(group string, messageType int, data []byte) int {
+	return svc.hub.broadcast(group, messageType, data)
+}
+
+// RegisterWebSocket 注册WebSocket接口 GET path, 握手前执行拦截器, 拦截器可以中断握手
+// 连接关闭时记录一条访问日志
+func (svc *Service) RegisterWebSocket(path string, handler WebSocketHandler, opts ...WebSocketOption) {
+	o := newWebSocketOptions(opts)
+	svc.engine.GET(path, func(ginCtx *gin.Context) {
+		otzCtx := svc.newHTTPContext(ginCtx)
+		defer otzctx.PutOTZCtx(otzCtx)
+		svc.chain(func(ctx context.Context) {
+			svc.serveWebSocket(ctx, ginCtx, o, handler)
+		})(otzCtx.Context())
+	})
+}
+
+// serveWebSocket 完成握手并处理连接, 处理函数返回后等待读写协程退出
+func (svc *Service) serveWebSocket(ctx context.Context, ginCtx *gin.Context, o *webSocketOptions,
+	handler WebSocketHandler) {
+	begin := time.Now()
+	conn, err := o.upgrader.Upgrade(ginCtx.Writer, ginCtx.Request, ginCtx.Writer.Header())
+	if err != nil {
+		// Upgrade失败时已返回错误响应
+		log.WarnCtxf(ctx, "websocket upgrade failed, err: %v", err)
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	c := &WebSocketConn{
+		conn:   conn,
+		opts:   o,
+		hub:    svc.hub,
+		ctx:    ctx,
+		cancel: cancel,
+		recv:   make(chan wsMessage),
+		send:   make(chan wsMessage, o.sendQueueSize),
+		groups: map[string]bool{},
+	}
+	if !svc.hub.add(c) {
+		c.closeWith(websocket.CloseGoingAway, "server shutting down", ErrWebSocketClosed)
+		c.writeLoop()
+		return
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		c.readLoop()
+	}()
+	go func() {
+		defer wg.Done()
+		c.writeLoop()
+	}()
+	defer func() {
+		if e := recover(); e != nil {
+			log.ErrorCtxf(ctx, "%v\n%s", e, string(debug.Stack()))
+			c.closeWith(websocket.CloseInternalServerErr, "internal error", errs.New(500, "internal error"))
+		}
+		c.Close()
+		wg.Wait()
+		svc.hub.remove(c)
+		log.InfoCtxf(ctx, "URI: %s, websocket close code: %d, cost: %dms",
+			ginCtx.Request.URL.Path, c.closeCode, time.Since(begin).Milliseconds(),
+		)
+	}()
+	handler(c)
+}
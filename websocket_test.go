@@ -0,0 +1,159 @@
+package otz
+
+import (
+	"context"
+	"errors"
+	"github.com/ShadowsGtt/otz/log"
+	"github.com/ShadowsGtt/otz/log/logtest"
+	"github.com/ShadowsGtt/otz/otzctx"
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSocket(t *testing.T) {
+	cfg, err := ParseConfig("otz_go.yaml", []byte("server:\n  ip: 127.0.0.1\n  port: 8080\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(WithConfig(cfg), WithLogger(logtest.New()), WithListener(ln))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Use(func(ctx context.Context, next HandlerFunc) {
+		if otzctx.OTZContext(ctx).GetGinCtx().Query("room") == "" {
+			otzctx.OTZContext(ctx).SetError(errors.New("room is required"))
+			return
+		}
+		next(ctx)
+	})
+	handlerDone := make(chan error, 10)
+	s.RegisterWebSocket("/ws", func(conn *WebSocketConn) {
+		ginCtx := otzctx.OTZContext(conn.Context()).GetGinCtx()
+		conn.Join(ginCtx.Query("room"))
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				handlerDone <- err
+				return
+			}
+			if err = conn.WriteMessage(messageType, append([]byte("echo "), data...)); err != nil {
+				handlerDone <- err
+				return
+			}
+		}
+	}, WithWSReadTimeout(200*time.Millisecond), WithWSPingInterval(50*time.Millisecond), WithWSMaxMessageSize(16))
+	go func() {
+		_ = s.Start()
+	}()
+
+	url := "ws://" + ln.Addr().String() + "/ws"
+	type result struct {
+		data string
+		err  error
+	}
+	// dial 建立连接并持续读取, 读取时客户端自动回复pong
+	dial := func(room string) (*websocket.Conn, chan result) {
+		var conn *websocket.Conn
+		var rsp *http.Response
+		for i := 0; i < 50; i++ {
+			if conn, rsp, err = websocket.DefaultDialer.Dial(url+"?room="+room, nil); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rsp.Header.Get(log.RequestIDHeader) == "" {
+			t.Fatal("request id should be set in handshake response")
+		}
+		results := make(chan result, 10)
+		go func() {
+			for {
+				_, data, err := conn.ReadMessage()
+				results <- result{data: string(data), err: err}
+				if err != nil {
+					return
+				}
+			}
+		}()
+		return conn, results
+	}
+	read := func(results chan result) result {
+		select {
+		case r := <-results:
+			return r
+		case <-time.After(time.Second):
+			t.Fatal("read message timeout")
+		}
+		return result{}
+	}
+
+	// 拦截器中断握手
+	if _, rsp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || rsp.StatusCode != http.StatusOK {
+		t.Fatalf("handshake should be rejected by interceptor, err: %v", err)
+	}
+
+	a, aResults := dial("r1")
+	b, bResults := dial("r1")
+	c, cResults := dial("r2")
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+	if err = a.WriteMessage(websocket.TextMessage, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if r := read(aResults); r.data != "echo hi" {
+		t.Fatalf("unexpected message %+v", r)
+	}
+
+	// 客户端回复pong, 超过读超时连接仍然保持
+	time.Sleep(400 * time.Millisecond)
+	if n := s.Broadcast("r1", TextMessage, []byte("news")); n != 2 {
+		t.Fatalf("expect broadcast to 2 connections, got %d", n)
+	}
+	for _, results := range []chan result{aResults, bResults} {
+		if r := read(results); r.data != "news" {
+			t.Fatalf("unexpected message %+v", r)
+		}
+	}
+
+	// 超过最大消息长度
+	if err = a.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 32))); err != nil {
+		t.Fatal(err)
+	}
+	if r := read(aResults); !websocket.IsCloseError(r.err, websocket.CloseMessageTooBig) {
+		t.Fatalf("expect close 1009, got %+v", r)
+	}
+	select {
+	case err = <-handlerDone:
+		if !errors.Is(err, websocket.ErrReadLimit) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler should return after connection closed")
+	}
+
+	// 停止服务时以1001关闭所有连接
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, results := range []chan result{bResults, cResults} {
+		if r := read(results); !websocket.IsCloseError(r.err, websocket.CloseGoingAway) {
+			t.Fatalf("expect close 1001, got %+v", r)
+		}
+	}
+	if n := s.Broadcast("r1", TextMessage, []byte("news")); n != 0 {
+		t.Fatalf("no connection should remain after shutdown, got %d", n)
+	}
+}